@@ -7,15 +7,25 @@ import (
 	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
 )
 
 type Handler struct {
 	Node            *maelstrom.Node
 	StorageMutex    *sync.Mutex
-	Storage         map[int]struct{}
+	Storage         *dedup.Set
+	Messages        []any
+	Hops            []int // Hops each message took to get here, indexed like Messages
+	NextSeq         int   // Sequence number for the next broadcast originating at this node
 	TopologyMutex   *sync.Mutex
 	TopologyStorage map[string][]string
-	Ttl             int
+	Ttl             int // Hops a new message may travel
+	TtlDrops        int // Messages this node could not forward because their TTL ran out
+	QueueLimit      int // Most unacknowledged messages per neighbor
+	GoroutineBudget int // Most retry goroutines alive at once, across all neighbors
+	PendingMutex    *sync.Mutex
+	Pending         map[string]int // Unacknowledged messages per neighbor
+	InFlight        int            // Retry goroutines currently alive
 }
 
 func (h *Handler) Broadcast(msg maelstrom.Message) error {
@@ -23,33 +33,58 @@ func (h *Handler) Broadcast(msg maelstrom.Message) error {
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	message := to_i(body["message"])
 	h.StorageMutex.Lock()
 	defer h.StorageMutex.Unlock()
-	if _, exists := h.Storage[message]; exists || body["ttl"] != nil && to_i(body["ttl"]) <= 0 {
-		return nil
-	}
-	go func() {
-		_ = h.Node.Reply(msg, map[string]any{
+	fromClient := body["origin"] == nil
+	if !fromClient && h.Storage.Seen(body["origin"].(string), to_i(body["seq"])) {
+		// Still ack, otherwise the sender keeps retrying
+		return h.Node.Reply(msg, map[string]any{
 			"type": "broadcast_ok",
 		})
-	}()
-
-	if body["ttl"] == nil {
-		body["ttl"] = h.Ttl
-	} else {
-		body["ttl"] = to_i(body["ttl"]) - 1
 	}
 
-	h.Storage[message] = struct{}{}
 	h.TopologyMutex.Lock()
-	defer h.TopologyMutex.Unlock()
 	neighbors := h.TopologyStorage[h.Node.ID()]
+	h.TopologyMutex.Unlock()
+	targets := make([]string, 0, len(neighbors))
 	for _, node := range neighbors {
-		if msg.Src == node || msg.Dest == node {
-			continue
+		if msg.Src != node && msg.Dest != node {
+			targets = append(targets, node)
 		}
+	}
+	// The TTL only limits forwarding, the message is still stored here
+	if fromClient {
+		body["ttl"] = h.Ttl
+		body["hops"] = 0
+	}
+	if len(targets) > 0 && to_i(body["ttl"]) <= 0 {
+		h.TtlDrops++
+		targets = nil
+	}
+	// Without room to forward the message, refuse it. Clients get an error, and so do other nodes,
+	// which retry shortly instead of waiting out their timeout.
+	if !h.reserve(targets) {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "broadcast queues are full")
+	}
+	go func() {
+		_ = h.Node.Reply(msg, map[string]any{
+			"type": "broadcast_ok",
+		})
+	}()
 
+	// Messages from clients have no origin yet, so this node becomes their origin
+	if fromClient {
+		h.NextSeq++
+		body["origin"] = h.Node.ID()
+		body["seq"] = h.NextSeq
+	}
+
+	h.Storage.Add(body["origin"].(string), to_i(body["seq"]))
+	h.Messages = append(h.Messages, body["message"])
+	h.Hops = append(h.Hops, to_i(body["hops"]))
+	body["ttl"] = to_i(body["ttl"]) - 1
+	body["hops"] = to_i(body["hops"]) + 1
+	for _, node := range targets {
 		// Create a copy of the body map for each goroutine
 		newBody := make(map[string]any)
 		for k, v := range body {
@@ -57,10 +92,9 @@ func (h *Handler) Broadcast(msg maelstrom.Message) error {
 		}
 
 		go func(node string, broadcast map[string]any) {
+			defer h.release(node)
 			for {
-				if err := h.Node.RPC(node, broadcast, func(_ maelstrom.Message) error {
-					return nil
-				}); err == nil {
+				if err := h.rpcWithTimeout(node, broadcast, time.Second); err == nil {
 					break
 				}
 				time.Sleep(100 * time.Millisecond)
@@ -70,6 +104,71 @@ func (h *Handler) Broadcast(msg maelstrom.Message) error {
 	return nil
 }
 
+// Takes one retry goroutine out of the budget for each target, or none at all if
+// the budget or any target's queue of unacknowledged messages is exhausted
+func (h *Handler) reserve(targets []string) bool {
+	h.PendingMutex.Lock()
+	defer h.PendingMutex.Unlock()
+	if h.InFlight+len(targets) > h.GoroutineBudget {
+		return false
+	}
+	for _, node := range targets {
+		if h.Pending[node] >= h.QueueLimit {
+			return false
+		}
+	}
+	h.InFlight += len(targets)
+	for _, node := range targets {
+		h.Pending[node]++
+	}
+	return true
+}
+
+func (h *Handler) release(node string) {
+	h.PendingMutex.Lock()
+	defer h.PendingMutex.Unlock()
+	h.InFlight--
+	h.Pending[node]--
+}
+
+// Sends body to node and waits up to timeout for it to be acknowledged
+func (h *Handler) rpcWithTimeout(node string, body map[string]any, timeout time.Duration) error {
+	replies := make(chan maelstrom.Message, 1)
+	if err := h.Node.RPC(node, body, func(reply maelstrom.Message) error {
+		replies <- reply
+		return nil
+	}); err != nil {
+		return err
+	}
+	select {
+	case reply := <-replies:
+		if err := reply.RPCError(); err != nil {
+			return err
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("broadcast to %s timed out", node)
+	}
+}
+
+// Returns how many messages are waiting to be acknowledged by each neighbor
+func (h *Handler) QueueDepth(msg maelstrom.Message) error {
+	h.PendingMutex.Lock()
+	depths := make(map[string]int, len(h.Pending))
+	for node, pending := range h.Pending {
+		depths[node] = pending
+	}
+	inFlight := h.InFlight
+	h.PendingMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type":      "queue_depth_ok",
+		"depths":    depths,
+		"in_flight": inFlight,
+		"limit":     h.QueueLimit,
+		"budget":    h.GoroutineBudget,
+	})
+}
+
 func (h *Handler) Read(msg maelstrom.Message) error {
 	var body map[string]any
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
@@ -77,14 +176,18 @@ func (h *Handler) Read(msg maelstrom.Message) error {
 	}
 	h.StorageMutex.Lock()
 	defer h.StorageMutex.Unlock()
-	messages := make([]int, 0, len(h.Storage))
-	for message := range h.Storage {
-		messages = append(messages, message)
-	}
+	messages := make([]any, len(h.Messages))
+	copy(messages, h.Messages)
 	newBody := map[string]any{
 		"type":     "read_ok",
 		"messages": messages,
 	}
+	if diagnostics, _ := body["diagnostics"].(bool); diagnostics {
+		hops := make([]int, len(h.Hops))
+		copy(hops, h.Hops)
+		newBody["hops"] = hops
+		newBody["ttl_drops"] = h.TtlDrops
+	}
 
 	return h.Node.Reply(msg, newBody)
 }
@@ -108,5 +211,10 @@ func (h *Handler) Topology(msg maelstrom.Message) error {
 }
 
 func to_i(any interface{}) int {
-	return int(any.(float64))
+	switch v := any.(type) {
+	case int:
+		return v
+	default:
+		return int(v.(float64))
+	}
 }
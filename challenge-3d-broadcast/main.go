@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
+	"github.com/notzree/gossip-glomers/env"
 )
 
 func main() {
@@ -12,14 +14,19 @@ func main() {
 	h := Handler{
 		Node:            n,
 		StorageMutex:    &sync.Mutex{},
-		Storage:         make(map[int]struct{}),
+		Storage:         dedup.New(),
 		TopologyMutex:   &sync.Mutex{},
 		TopologyStorage: make(map[string][]string),
 		Ttl:             2,
+		QueueLimit:      env.Int("BROADCAST_QUEUE_LIMIT", 1000),
+		GoroutineBudget: env.Int("BROADCAST_GOROUTINE_BUDGET", 10000),
+		PendingMutex:    &sync.Mutex{},
+		Pending:         make(map[string]int),
 	}
 	n.Handle("broadcast", h.Broadcast)
 	n.Handle("read", h.Read)
 	n.Handle("topology", h.Topology)
+	n.Handle("queue_depth", h.QueueDepth)
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
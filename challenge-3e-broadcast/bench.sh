@@ -0,0 +1,25 @@
+#!/bin/bash
+# Usage: ./bench.sh [mode] [node counts...], e.g. ./bench.sh batch 5 10 25
+# Runs a saturating broadcast workload (about half broadcasts, half reads) at each node count and
+# prints how many of each completed per second, along with msgs-per-op.
+
+maelstrom_path="../maelstrom"
+cwd=$(pwd)
+mode=${1:-batch}
+shift $(( $# > 0 ? 1 : 0 ))
+node_counts=${*:-5 10 25}
+time_limit=20
+
+go build -o bin
+cd "$maelstrom_path" || exit
+for nodes in $node_counts; do
+    BROADCAST_MODE=$mode ./maelstrom test -w broadcast --bin $cwd/bin --node-count $nodes --time-limit $time_limit \
+        --rate 2000 --concurrency 4n --latency 0 > /dev/null 2>&1
+    results=$(tr '\n' ' ' < store/latest/results.edn)
+    for f in broadcast read; do
+        ok=$(grep -o ":$f {[^}]*}" <<< "$results" | head -1 | grep -o ':ok-count [0-9]*' | cut -d' ' -f2)
+        echo "nodes=$nodes $f: $(( ${ok:-0} / time_limit )) ops/s"
+    done
+    echo "nodes=$nodes $(grep -o ':msgs-per-op [0-9.]*' <<< "$results" | tail -1)"
+done
+cd "$cwd" || exit
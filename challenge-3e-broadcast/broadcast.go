@@ -3,43 +3,86 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"log"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
 )
 
 type Handler struct {
 	Node            *maelstrom.Node
+	Config          Config
 	StorageMutex    *sync.Mutex
-	Storage         map[int]struct{}
+	Storage         *dedup.Set
+	Messages        *Messages
+	Stability       *Stability
+	NextSeq         int // Sequence number for the next broadcast originating at this node
+	Causal          *CausalBuffer
+	Sequencer       *Sequencer
+	PubSub          *PubSub
+	Routes          *Routes
+	Gossip          *Gossip
+	Membership      *Membership
 	TopologyMutex   *sync.Mutex
 	TopologyStorage map[string][]string
-	Ttl             int
+	Ttl             int          // Hops a new entry may travel
+	TtlDrops        atomic.Int64 // Entries this node could not forward to everyone it should have because their TTL ran out
 	BroadcastMutex  sync.Mutex
-	BroadcastQueue  map[string][]int
+	BroadcastQueue  map[string][]Entry
+	InFlight        map[string]*InFlightBatch
+}
+
+const (
+	batchTimeout = time.Second
+	maxBatchSize = 1024
+)
+
+// A batch that has been sent to a neighbor but not acknowledged yet. Its entries stay at the
+// front of the neighbor's queue until the ack arrives, so a lost batch is simply sent again.
+type InFlightBatch struct {
+	Size int
+	Sent time.Time
 }
 
 func (h *Handler) BatchBroadcast() error {
 	for {
 		time.Sleep(500 * time.Millisecond)
 		h.BroadcastMutex.Lock()
-		for node, messages := range h.BroadcastQueue {
-			if len(messages) == 0 || node == h.Node.ID() {
+		for node, entries := range h.BroadcastQueue {
+			if len(entries) == 0 || node == h.Node.ID() {
+				continue
+			}
+			if inFlight := h.InFlight[node]; inFlight != nil && time.Since(inFlight.Sent) < batchTimeout {
 				continue
 			}
+			if h.InFlight[node] == nil && len(h.InFlight) >= h.Config.InFlightLimit {
+				continue
+			}
+			entries = entries[:min(len(entries), maxBatchSize)]
+			batch := &InFlightBatch{Size: len(entries), Sent: time.Now()}
 			broadcast := map[string]any{
 				"type":    "broadcast",
-				"message": messages,
+				"entries": entries,
 			}
-			if err := h.Node.RPC(node, broadcast, func(_ maelstrom.Message) error {
+			if err := h.Node.RPC(node, broadcast, func(reply maelstrom.Message) error {
+				h.BroadcastMutex.Lock()
+				defer h.BroadcastMutex.Unlock()
+				// Ignore acks for batches that already timed out and were resent
+				if h.InFlight[node] != batch || reply.RPCError() != nil {
+					return nil
+				}
+				h.Routes.Observe(h.Node.ID(), node, time.Since(batch.Sent))
+				h.BroadcastQueue[node] = h.BroadcastQueue[node][batch.Size:]
+				delete(h.InFlight, node)
 				return nil
 			}); err != nil {
 				continue // Retry later
 			}
-			h.BroadcastQueue[node] = []int{}
-
+			h.InFlight[node] = batch
 		}
 		h.BroadcastMutex.Unlock()
 	}
@@ -50,14 +93,23 @@ func (h *Handler) Broadcast(msg maelstrom.Message) error {
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	h.StorageMutex.Lock()
-	defer h.StorageMutex.Unlock()
-	h.TopologyMutex.Lock()
-	neighbors := h.TopologyStorage[h.Node.ID()]
-	h.TopologyMutex.Unlock()
-
-	if body["ttl"] != nil && to_i(body["ttl"]) <= 0 {
-		return nil
+	if member, _ := h.isMember(); !member && body["entries"] == nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not a member of the cluster")
+	}
+	// Refusing a batch leaves it in the sender's queue, so backpressure propagates upstream to the clients
+	incoming := 1
+	if entries, ok := body["entries"].([]any); ok {
+		incoming = len(entries)
+	}
+	if h.queueFull(incoming, msg.Src) {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "broadcast queues are full")
+	}
+	// Clients send a single payload, other nodes send batches of entries
+	var batch struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.Unmarshal(msg.Body, &batch); err != nil {
+		return err
 	}
 	go func() {
 		_ = h.Node.Reply(msg, map[string]any{
@@ -65,86 +117,262 @@ func (h *Handler) Broadcast(msg maelstrom.Message) error {
 		})
 	}()
 
-	if body["ttl"] == nil {
-		body["ttl"] = h.Ttl
-	} else {
-		body["ttl"] = to_i(body["ttl"]) - 1
+	h.StorageMutex.Lock()
+	defer h.StorageMutex.Unlock()
+	entries := batch.Entries
+	if body["entries"] == nil {
+		entries = []Entry{h.originate(body["message"])}
 	}
 
-	messages := ToIntArray(body["message"])
+	h.ingest(entries, msg.Src)
+	return nil
+}
+
+// Creates the entry for a message a client sent to this node. Must hold StorageMutex.
+func (h *Handler) originate(message any) Entry {
+	h.NextSeq++
+	entry := Entry{Origin: h.Node.ID(), Seq: h.NextSeq, Message: message}
+	if h.Config.Mode == CausalMode {
+		entry.Clock = h.Causal.Clock()
+	}
+	entry.Ttl = h.Ttl
+	if h.Config.Routing == LatencyRouting {
+		entry.Route = h.Routes.Tree(h.Node.ID(), h.members())
+		// A route can't loop, so its depth is the hop limit
+		if entry.Route != nil {
+			entry.Ttl = depth(entry.Route, h.Node.ID())
+		}
+	}
+	if h.Config.Routing == GossipRouting {
+		entry.Round = h.Gossip.Current()
+	}
+	return entry
+}
+
+// Reports whether queueing incoming more entries could push any neighbor's queue over the limit.
+// The sender's own queue is skipped, since nothing it sends is forwarded back to it and two full
+// neighbors would otherwise refuse each other's batches forever.
+func (h *Handler) queueFull(incoming int, src string) bool {
+	h.BroadcastMutex.Lock()
+	defer h.BroadcastMutex.Unlock()
+	for node, entries := range h.BroadcastQueue {
+		if node != src && len(entries)+incoming > h.Config.QueueLimit {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns how many entries are queued for each neighbor, and how many of those are in flight
+func (h *Handler) QueueDepth(msg maelstrom.Message) error {
+	h.BroadcastMutex.Lock()
+	depths := make(map[string]int, len(h.BroadcastQueue))
+	inFlight := make(map[string]int, len(h.InFlight))
+	for node, entries := range h.BroadcastQueue {
+		depths[node] = len(entries)
+	}
+	for node, batch := range h.InFlight {
+		inFlight[node] = batch.Size
+	}
+	h.BroadcastMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type":      "queue_depth_ok",
+		"depths":    depths,
+		"in_flight": inFlight,
+		"limit":     h.Config.QueueLimit,
+	})
+}
+
+// Stores every entry that has not been seen before and queues it for the nodes it should be forwarded to.
+// Routed entries go to the receiving node's children in their route, publications only go to neighbors
+// with subscribers for their topic behind them, and everything else goes to all topology neighbors.
+// Must hold StorageMutex, so that every link carries entries in the order they were stored.
+func (h *Handler) ingest(entries []Entry, src string) {
+	h.TopologyMutex.Lock()
+	neighbors := h.TopologyStorage[h.Node.ID()]
+	h.TopologyMutex.Unlock()
 
-	for _, message := range messages {
-		if _, exists := h.Storage[message]; exists {
+	stored := make([]Entry, 0, len(entries))
+	queued := make(map[string][]Entry)
+	for _, entry := range entries {
+		if entry.Topic != "" && !h.PubSub.Accept(entry) || entry.Topic == "" && !h.Storage.Add(entry.Origin, entry.Seq) {
 			continue
 		}
-		h.Storage[message] = struct{}{}
-		for _, node := range neighbors {
-			if msg.Src == node || msg.Dest == node {
+		route := entry.Route
+		entry.Route = nil
+		if entry.Topic != "" {
+			h.PubSub.Store(entry)
+		} else {
+			stored = append(stored, entry)
+		}
+		targets := neighbors
+		if route != nil {
+			targets = route[h.Node.ID()]
+		} else if entry.Topic == "" && h.Config.Routing == GossipRouting {
+			// Push-pull rounds spread broadcasts instead
+			h.Gossip.Arrive(entry)
+			targets = nil
+		}
+		forwards := make([]string, 0, len(targets))
+		for _, node := range targets {
+			if src == node || h.Node.ID() == node {
+				continue
+			}
+			if entry.Topic != "" && !h.PubSub.Interested(node, entry.Topic) {
 				continue
 			}
-			h.BroadcastMutex.Lock()
-			h.BroadcastQueue[node] = append(h.BroadcastQueue[node], message)
-			h.BroadcastMutex.Unlock()
+			forwards = append(forwards, node)
+		}
+		if len(forwards) > 0 && entry.Ttl <= 0 {
+			h.TtlDrops.Add(1)
+			continue
+		}
+		for _, node := range forwards {
+			forwarded := entry
+			forwarded.Ttl--
+			forwarded.Hops++
+			if route != nil {
+				forwarded.Route = subtree(route, node)
+			}
+			queued[node] = append(queued[node], forwarded)
 		}
 	}
-	return nil
+	h.store(stored)
+
+	h.BroadcastMutex.Lock()
+	defer h.BroadcastMutex.Unlock()
+	for node, forwarded := range queued {
+		h.BroadcastQueue[node] = append(h.BroadcastQueue[node], forwarded...)
+	}
 }
 
+// Appends entries to the log, or in causal mode every entry they make deliverable, as one snapshot
+func (h *Handler) store(entries []Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	switch h.Config.Mode {
+	case CausalMode:
+		delivered := make([]Entry, 0, len(entries))
+		for _, entry := range entries {
+			delivered = append(delivered, h.Causal.Receive(entry)...)
+		}
+		h.Messages.Append(delivered, h.Causal.Clock())
+	case TotalOrder:
+		h.Messages.Append(entries, nil)
+		for _, entry := range entries {
+			h.Sequencer.Receive(entry)
+		}
+	default:
+		h.Messages.Append(entries, nil)
+	}
+}
+
+// Returns every stored message, or only the ones stored since the given cursor. Reads work off the
+// latest snapshot and never take StorageMutex, so they don't wait for ingest.
 func (h *Handler) Read(msg maelstrom.Message) error {
 	var body map[string]any
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	h.StorageMutex.Lock()
-	defer h.StorageMutex.Unlock()
-	messages := make([]int, 0, len(h.Storage))
-	for message := range h.Storage {
-		messages = append(messages, message)
+	if member, joining := h.isMember(); !member || joining {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not serving reads until joined")
 	}
+	snapshot := h.Messages.Load()
 	newBody := map[string]any{
-		"type":     "read_ok",
-		"messages": messages,
+		"type":   "read_ok",
+		"cursor": h.encodeCursor(snapshot.Len()),
+	}
+	if h.Config.Mode == CausalMode {
+		newBody["clock"] = snapshot.Clock
+	}
+	offset := 0
+	if body["cursor"] != nil {
+		cursor, ok := body["cursor"].(string)
+		if !ok {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, "cursor must be a string")
+		}
+		var err error
+		if offset, err = h.decodeCursor(cursor, snapshot); err != nil {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+		}
+	}
+	newBody["messages"] = snapshot.From(offset)
+	// Checkpointed messages have shed their metadata, so only the log has hop counts
+	if diagnostics, _ := body["diagnostics"].(bool); diagnostics {
+		newBody["entries"] = hops(snapshot.Log[max(0, offset-len(snapshot.Checkpoint)):])
+		newBody["ttl_drops"] = h.TtlDrops.Load()
+		newBody["checkpointed"] = len(snapshot.Checkpoint)
 	}
-
 	return h.Node.Reply(msg, newBody)
 }
 
+// The star is built from the current members rather than the topology Maelstrom suggests
 func (h *Handler) Topology(msg maelstrom.Message) error {
 	go func() {
 		_ = h.Node.Reply(msg, map[string]any{
 			"type": "topology_ok",
 		})
 	}()
-	tree := make(map[string][]string)
-	nodeIds := h.Node.NodeIDs()
-	for id := 1; id < len(nodeIds); id++ {
-		tree[fmt.Sprintf("n%d", 0)] = append(tree[fmt.Sprintf("n%d", 0)], fmt.Sprintf("n%d", id))  // Add all nodes to the root node
-		tree[fmt.Sprintf("n%d", id)] = append(tree[fmt.Sprintf("n%d", id)], fmt.Sprintf("n%d", 0)) // Add the root node to all nodes
-	}
-	h.TopologyMutex.Lock()
-	defer h.TopologyMutex.Unlock()
-	h.TopologyStorage = tree
+	h.rebuildTopology()
 	return nil
 }
 
-func to_i(any interface{}) int {
-	return int(any.(float64))
+// Sends body to node and waits up to timeout for the reply
+func (h *Handler) rpcWithTimeout(node string, body map[string]any, timeout time.Duration) (maelstrom.Message, error) {
+	replies := make(chan maelstrom.Message, 1)
+	if err := h.Node.RPC(node, body, func(reply maelstrom.Message) error {
+		replies <- reply
+		return nil
+	}); err != nil {
+		return maelstrom.Message{}, err
+	}
+	select {
+	case reply := <-replies:
+		if err := reply.RPCError(); err != nil {
+			return reply, err
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return maelstrom.Message{}, fmt.Errorf("%s timed out", body["type"])
+	}
 }
 
-func ToIntArray(any interface{}) []int {
-	switch v := any.(type) {
-	case float64:
-		// If it's a single float64, convert it to an int and return as a slice of one element
-		return []int{int(v)}
-	case []interface{}:
-		// If it's an array, iterate and convert each element to int
-		intArray := make([]int, len(v))
-		for i, elem := range v {
-			intArray[i] = int(elem.(float64))
+// Cursors are opaque to clients: they name the node that issued them and an offset into everything it
+// has stored, checkpoint first and log after, which stays valid when the log is compacted
+func (h *Handler) encodeCursor(offset int) string {
+	return fmt.Sprintf("%s:%d", h.Node.ID(), offset)
+}
+
+func (h *Handler) decodeCursor(cursor string, snapshot *Snapshot) (int, error) {
+	node, rawOffset, found := strings.Cut(cursor, ":")
+	if !found || node != h.Node.ID() {
+		return 0, fmt.Errorf("cursor %q was not issued by %s", cursor, h.Node.ID())
+	}
+	offset, err := strconv.Atoi(rawOffset)
+	if err != nil || offset < 0 || offset > snapshot.Len() {
+		return 0, fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return offset, nil
+}
+
+// Describes how many hops each entry took to get here, for read diagnostics
+func hops(entries []Entry) []map[string]any {
+	described := make([]map[string]any, len(entries))
+	for i, entry := range entries {
+		described[i] = map[string]any{
+			"origin": entry.Origin,
+			"seq":    entry.Seq,
+			"hops":   entry.Hops,
 		}
-		return intArray
-	default:
-		log.Fatal("Invalid type")
-		return nil
 	}
+	return described
+}
+
+func payloads(entries []Entry) []any {
+	messages := make([]any, len(entries))
+	for i, entry := range entries {
+		messages[i] = entry.Message
+	}
+	return messages
 }
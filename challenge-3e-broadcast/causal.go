@@ -0,0 +1,64 @@
+package main
+
+// CausalBuffer holds entries back until everything that causally precedes them has been delivered.
+// An entry from origin o with sequence s depends on s-1 earlier entries from o, and on
+// entry.Clock[k] entries from every other origin k.
+type CausalBuffer struct {
+	Delivered map[string]int // Number of delivered entries per origin, i.e. this node's vector clock
+	Buffered  []Entry
+}
+
+func NewCausalBuffer() *CausalBuffer {
+	return &CausalBuffer{
+		Delivered: make(map[string]int),
+	}
+}
+
+// Returns a copy of the vector clock to stamp on a new entry originating at this node
+func (c *CausalBuffer) Clock() map[string]int {
+	clock := make(map[string]int, len(c.Delivered))
+	for origin, count := range c.Delivered {
+		clock[origin] = count
+	}
+	return clock
+}
+
+// Buffers entry and returns every entry that became deliverable because of it, in causal order.
+// Copies of entries that were already delivered are dropped.
+func (c *CausalBuffer) Receive(entry Entry) []Entry {
+	if entry.Seq <= c.Delivered[entry.Origin] {
+		return nil
+	}
+	c.Buffered = append(c.Buffered, entry)
+	delivered := make([]Entry, 0, 1)
+	for progress := true; progress; {
+		progress = false
+		remaining := c.Buffered[:0]
+		for _, buffered := range c.Buffered {
+			if buffered.Seq <= c.Delivered[buffered.Origin] {
+				continue
+			}
+			if !c.deliverable(buffered) {
+				remaining = append(remaining, buffered)
+				continue
+			}
+			c.Delivered[buffered.Origin]++
+			delivered = append(delivered, buffered)
+			progress = true
+		}
+		c.Buffered = remaining
+	}
+	return delivered
+}
+
+func (c *CausalBuffer) deliverable(entry Entry) bool {
+	if c.Delivered[entry.Origin] != entry.Seq-1 {
+		return false
+	}
+	for origin, count := range entry.Clock {
+		if origin != entry.Origin && c.Delivered[origin] < count {
+			return false
+		}
+	}
+	return true
+}
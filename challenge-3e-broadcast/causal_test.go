@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+// Simulates nodes that broadcast and deliver each other's entries in random order, each through its
+// own CausalBuffer, so the clocks on the entries are the ones real nodes would stamp
+func causalHistory(rng *rand.Rand, nodes int, steps int) []Entry {
+	buffers := make([]*CausalBuffer, nodes)
+	for i := range buffers {
+		buffers[i] = NewCausalBuffer()
+	}
+	entries := make([]Entry, 0, steps)
+	for range steps {
+		node := rng.IntN(nodes)
+		if len(entries) == 0 || rng.IntN(3) == 0 {
+			origin := fmt.Sprintf("n%d", node)
+			entry := Entry{
+				Origin:  origin,
+				Seq:     buffers[node].Delivered[origin] + 1,
+				Message: len(entries),
+				Clock:   buffers[node].Clock(),
+			}
+			entries = append(entries, entry)
+			buffers[node].Receive(entry)
+			continue
+		}
+		buffers[node].Receive(entries[rng.IntN(len(entries))])
+	}
+	return entries
+}
+
+// Returns the entries shuffled, with about a quarter of them sent twice
+func reordered(rng *rand.Rand, entries []Entry) []Entry {
+	shuffled := append([]Entry(nil), entries...)
+	for _, entry := range entries {
+		if rng.IntN(4) == 0 {
+			shuffled = append(shuffled, entry)
+		}
+	}
+	rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return shuffled
+}
+
+// Feeds entries to buffer and fails unless every delivered prefix is causally closed: an entry is
+// only delivered once, right after its origin's previous entry and everything its clock covers
+func deliverChecked(t *testing.T, buffer *CausalBuffer, delivered map[string]int, entries []Entry) {
+	t.Helper()
+	for _, entry := range entries {
+		for _, next := range buffer.Receive(entry) {
+			if next.Seq != delivered[next.Origin]+1 {
+				t.Fatalf("delivered %s/%d after %d of its origin's entries", next.Origin, next.Seq, delivered[next.Origin])
+			}
+			for origin, count := range next.Clock {
+				if origin != next.Origin && delivered[origin] < count {
+					t.Fatalf("delivered %s/%d before %s/%d it depends on", next.Origin, next.Seq, origin, count)
+				}
+			}
+			delivered[next.Origin] = next.Seq
+		}
+	}
+}
+
+func TestCausalDeliveryUnderReordering(t *testing.T) {
+	for seed := range uint64(200) {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		entries := causalHistory(rng, 4, 300)
+		buffer := NewCausalBuffer()
+		delivered := make(map[string]int)
+		deliverChecked(t, buffer, delivered, reordered(rng, entries))
+		if total := countDelivered(delivered); total != len(entries) {
+			t.Fatalf("seed %d: delivered %d of %d entries", seed, total, len(entries))
+		}
+		if len(buffer.Buffered) != 0 {
+			t.Fatalf("seed %d: %d entries left buffered", seed, len(buffer.Buffered))
+		}
+	}
+}
+
+// Withholds one origin's entries, as a partition would, and checks that nothing depending on them
+// is delivered until they arrive, after which everything is
+func TestCausalDeliveryAcrossPartition(t *testing.T) {
+	for seed := range uint64(200) {
+		rng := rand.New(rand.NewPCG(seed, 1))
+		entries := causalHistory(rng, 4, 300)
+		cut := entries[rng.IntN(len(entries))].Origin
+		reachable, partitioned := make([]Entry, 0), make([]Entry, 0)
+		for _, entry := range entries {
+			if entry.Origin == cut {
+				partitioned = append(partitioned, entry)
+			} else {
+				reachable = append(reachable, entry)
+			}
+		}
+		buffer := NewCausalBuffer()
+		delivered := make(map[string]int)
+		deliverChecked(t, buffer, delivered, reordered(rng, reachable))
+		if delivered[cut] != 0 {
+			t.Fatalf("seed %d: delivered entries from partitioned %s", seed, cut)
+		}
+		deliverChecked(t, buffer, delivered, reordered(rng, partitioned))
+		if total := countDelivered(delivered); total != len(entries) {
+			t.Fatalf("seed %d: delivered %d of %d entries after healing", seed, total, len(entries))
+		}
+	}
+}
+
+func countDelivered(delivered map[string]int) int {
+	total := 0
+	for _, count := range delivered {
+		total += count
+	}
+	return total
+}
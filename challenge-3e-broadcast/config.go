@@ -0,0 +1,41 @@
+package main
+
+import (
+	"time"
+
+	"github.com/notzree/gossip-glomers/env"
+)
+
+const (
+	BatchMode  = "batch"       // Batched best-effort gossip over the star topology
+	CausalMode = "causal"      // Batched gossip, delivered to read only in causal order
+	TotalOrder = "total-order" // Batched gossip, plus a sequencer that orders entries for ordered_read
+	GSetMode   = "g-set"       // Batched gossip behind Maelstrom's g-set workload, i.e. add and read
+)
+
+// Config selects and tunes the broadcast mode. Everything is read from the environment (see test.sh).
+type Config struct {
+	Mode      string
+	Sequencer string // FixedSequencer or ElectedSequencer, only used in total order mode
+	// Most entries queued for a single neighbor. Clients get temporarily-unavailable while any queue is full.
+	QueueLimit int
+	// Most unacknowledged batches in flight at once. Every reply runs on its own goroutine, so this bounds them.
+	InFlightLimit int
+	Routing       string        // StarRouting, LatencyRouting or GossipRouting
+	PingInterval  time.Duration // How often round trips to every peer are measured in latency routing mode
+	Fanout        int           // Peers each node gossips with per round in gossip routing mode
+	RoundInterval time.Duration // Length of a gossip round
+}
+
+func LoadConfig() Config {
+	return Config{
+		Mode:          env.String("BROADCAST_MODE", BatchMode),
+		Sequencer:     env.String("BROADCAST_SEQUENCER", FixedSequencer),
+		QueueLimit:    env.Int("BROADCAST_QUEUE_LIMIT", 10000),
+		InFlightLimit: env.Int("BROADCAST_IN_FLIGHT_LIMIT", 64),
+		Routing:       env.String("BROADCAST_ROUTING", StarRouting),
+		PingInterval:  time.Duration(env.Int("BROADCAST_PING_INTERVAL_MS", 2000)) * time.Millisecond,
+		Fanout:        env.Int("BROADCAST_FANOUT", 3),
+		RoundInterval: time.Duration(env.Int("BROADCAST_ROUND_INTERVAL_MS", 200)) * time.Millisecond,
+	}
+}
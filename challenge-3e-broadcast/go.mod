@@ -4,7 +4,16 @@ go 1.22.6
 
 require (
 	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20240408130303-0186f398f965
+	github.com/notzree/gossip-glomers/crdt v0.0.0
+	github.com/notzree/gossip-glomers/dedup v0.0.0
+	github.com/notzree/gossip-glomers/env v0.0.0
 	github.com/notzree/gossip-glomers/v2 v2.0.0-20240811035904-c00355fe11f0
 )
 
 require github.com/google/uuid v1.6.0 // indirect
+
+replace github.com/notzree/gossip-glomers/crdt => ../crdt
+
+replace github.com/notzree/gossip-glomers/dedup => ../dedup
+
+replace github.com/notzree/gossip-glomers/env => ../env
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
+)
+
+// How many rounds an entry keeps being pushed after this node stored it. Anything older is only
+// sent when a peer's digest shows it is missing.
+const gossipRecentRounds = 3
+
+// Gossip is the state of push-pull gossip mode. Rounds are counted locally from init, and since every
+// node uses the same interval, the round an entry was broadcast in and the round it arrived in are
+// comparable across nodes to within about one round.
+type Gossip struct {
+	Mutex    *sync.Mutex
+	Round    int
+	Marks    []int          // Offset into storage at the start of each of the last gossipRecentRounds rounds, oldest first
+	Arrivals map[string]int // Rounds each entry took to reach this node, by origin/seq, until it is compacted
+}
+
+func NewGossip() *Gossip {
+	return &Gossip{
+		Mutex:    &sync.Mutex{},
+		Marks:    []int{0},
+		Arrivals: make(map[string]int),
+	}
+}
+
+func (g *Gossip) Current() int {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	return g.Round
+}
+
+// Starts a new round with storage at offset and returns the offset the recent entries start at,
+// i.e. where storage was gossipRecentRounds rounds ago
+func (g *Gossip) Advance(offset int) int {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	g.Round++
+	recent := g.Marks[0]
+	g.Marks = append(g.Marks, offset)
+	if len(g.Marks) > gossipRecentRounds {
+		g.Marks = g.Marks[1:]
+	}
+	return recent
+}
+
+func (g *Gossip) Arrive(entry Entry) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	g.Arrivals[arrivalKey(entry)] = max(0, g.Round-entry.Round)
+}
+
+// Drops the arrivals of entries that were folded into the checkpoint. Every node has stored those,
+// and without this the map (and every arrivals reply) would grow for as long as the node runs.
+func (g *Gossip) Forget(entries []Entry) {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	for _, entry := range entries {
+		delete(g.Arrivals, arrivalKey(entry))
+	}
+}
+
+func arrivalKey(entry Entry) string {
+	return fmt.Sprintf("%s/%d", entry.Origin, entry.Seq)
+}
+
+func (g *Gossip) copy() map[string]int {
+	g.Mutex.Lock()
+	defer g.Mutex.Unlock()
+	arrivals := make(map[string]int, len(g.Arrivals))
+	for id, rounds := range g.Arrivals {
+		arrivals[id] = rounds
+	}
+	return arrivals
+}
+
+// Every round, pushes the recent entries and our digest to Fanout random members, which answer with
+// whatever the digest shows we are missing
+func (h *Handler) RunGossip() error {
+	for {
+		time.Sleep(h.Config.RoundInterval)
+		if h.Node.ID() == "" {
+			continue
+		}
+		h.StorageMutex.Lock()
+		snapshot := h.Messages.Load()
+		digest, err := json.Marshal(h.Storage)
+		h.StorageMutex.Unlock()
+		if err != nil {
+			continue
+		}
+		mark := h.Gossip.Advance(snapshot.Len())
+		recent := snapshot.Log[max(0, mark-len(snapshot.Checkpoint)):]
+		// Anything past the cap is still pushed in a later round or pulled with the digest
+		recent = forwarded(recent[:min(len(recent), maxBatchSize)])
+
+		peers := slices.DeleteFunc(h.members(), func(node string) bool { return node == h.Node.ID() })
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+		for _, node := range peers[:min(len(peers), h.Config.Fanout)] {
+			_ = h.Node.RPC(node, map[string]any{
+				"type":    "gossip",
+				"entries": recent,
+				"digest":  json.RawMessage(digest),
+			}, h.pulled)
+		}
+	}
+}
+
+// Stores the pushed entries and replies with every logged entry the sender's digest lacks
+func (h *Handler) GossipPush(msg maelstrom.Message) error {
+	var body struct {
+		Entries []Entry    `json:"entries"`
+		Digest  *dedup.Set `json:"digest"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Digest == nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "gossip needs a digest")
+	}
+	if len(body.Entries) > maxBatchSize {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("gossip pushes at most %d entries", maxBatchSize))
+	}
+	h.StorageMutex.Lock()
+	h.ingest(body.Entries, msg.Src)
+	h.StorageMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type":    "gossip_ok",
+		"entries": forwarded(h.missing(body.Digest)),
+	})
+}
+
+// Returns up to maxBatchSize stored entries the digest has not seen. Checkpointed entries are
+// stored everywhere already, so only the log can have anything missing.
+func (h *Handler) missing(digest *dedup.Set) []Entry {
+	missing := make([]Entry, 0)
+	for _, entry := range h.Messages.Load().Log {
+		if len(missing) == maxBatchSize {
+			break
+		}
+		if !digest.Seen(entry.Origin, entry.Seq) {
+			missing = append(missing, entry)
+		}
+	}
+	return missing
+}
+
+func (h *Handler) pulled(reply maelstrom.Message) error {
+	var body struct {
+		Entries []Entry `json:"entries"`
+	}
+	if err := json.Unmarshal(reply.Body, &body); err != nil || reply.RPCError() != nil {
+		return nil
+	}
+	h.StorageMutex.Lock()
+	defer h.StorageMutex.Unlock()
+	h.ingest(body.Entries, reply.Src)
+	return nil
+}
+
+// Reports how many rounds messages took to reach every member. Only messages that every member has
+// stored are counted, so the answer covers converged messages only.
+func (h *Handler) Convergence(msg maelstrom.Message) error {
+	return h.Node.Reply(msg, h.convergence())
+}
+
+func (h *Handler) convergence() map[string]any {
+	slowest := h.Gossip.copy()
+	members := h.members()
+	for _, node := range members {
+		if node == h.Node.ID() {
+			continue
+		}
+		reply, err := h.rpcWithTimeout(node, map[string]any{"type": "arrivals"}, time.Second)
+		var body struct {
+			Arrivals map[string]int `json:"arrivals"`
+		}
+		if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+			return map[string]any{
+				"type":  "convergence_ok",
+				"error": node + " did not report its arrivals",
+			}
+		}
+		for id, rounds := range slowest {
+			if arrived, ok := body.Arrivals[id]; ok {
+				slowest[id] = max(rounds, arrived)
+			} else {
+				delete(slowest, id)
+			}
+		}
+	}
+	rounds := make([]int, 0, len(slowest))
+	for _, r := range slowest {
+		rounds = append(rounds, r)
+	}
+	slices.Sort(rounds)
+	result := map[string]any{
+		"type":     "convergence_ok",
+		"messages": len(rounds),
+		"round_ms": h.Config.RoundInterval.Milliseconds(),
+	}
+	if len(rounds) > 0 {
+		result["median_rounds"] = rounds[len(rounds)/2]
+		result["max_rounds"] = rounds[len(rounds)-1]
+	}
+	return result
+}
+
+func (h *Handler) Arrivals(msg maelstrom.Message) error {
+	return h.Node.Reply(msg, map[string]any{
+		"type":     "arrivals_ok",
+		"arrivals": h.Gossip.copy(),
+	})
+}
+
+// Periodically logs convergence from the first member, so it ends up in Maelstrom's node logs
+func (h *Handler) LogConvergence() error {
+	for {
+		time.Sleep(5 * time.Second)
+		if members := h.members(); len(members) == 0 || members[0] != h.Node.ID() {
+			continue
+		}
+		result := h.convergence()
+		if failure, failed := result["error"]; failed {
+			log.Printf("convergence: %v", failure)
+			continue
+		}
+		log.Printf("convergence: %d messages, median %v rounds, max %v rounds, %v ms per round",
+			result["messages"], result["median_rounds"], result["max_rounds"], result["round_ms"])
+	}
+}
+
+// Copies entries to send on, counting the hop they are about to take
+func forwarded(entries []Entry) []Entry {
+	copied := make([]Entry, len(entries))
+	for i, entry := range entries {
+		entry.Hops++
+		entry.Route = nil
+		copied[i] = entry
+	}
+	return copied
+}
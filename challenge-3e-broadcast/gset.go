@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/crdt"
+)
+
+// Adds an element to the set. It travels exactly like a client broadcast, so it is batched, retried
+// until every neighbor acks it, and survives partitions the same way.
+func (h *Handler) Add(msg maelstrom.Message) error {
+	var body struct {
+		Element any `json:"element"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if member, _ := h.isMember(); !member {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not a member of the cluster")
+	}
+	if h.queueFull(1, msg.Src) {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "broadcast queues are full")
+	}
+	h.StorageMutex.Lock()
+	h.ingest([]Entry{h.originate(body.Element)}, msg.Src)
+	h.StorageMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type": "add_ok",
+	})
+}
+
+// Returns every element added anywhere that has reached this node. An element added more than
+// once is stored once per add, so the stored payloads are collected into a JSONSet, which drops
+// the duplicates.
+func (h *Handler) ReadSet(msg maelstrom.Message) error {
+	if member, joining := h.isMember(); !member || joining {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not serving reads until joined")
+	}
+	set := crdt.NewJSONSet()
+	for _, element := range h.Messages.Load().From(0) {
+		if err := set.Add(element); err != nil {
+			return err
+		}
+	}
+	return h.Node.Reply(msg, map[string]any{
+		"type":  "read_ok",
+		"value": set,
+	})
+}
@@ -5,24 +5,76 @@ import (
 	"sync"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
+	"github.com/notzree/gossip-glomers/env"
 )
 
 func main() {
 	n := maelstrom.NewNode()
+	config := LoadConfig()
 	h := Handler{
 		Node:            n,
+		Config:          config,
 		StorageMutex:    &sync.Mutex{},
-		Storage:         make(map[int]struct{}),
+		Storage:         dedup.New(),
+		Messages:        NewMessages(),
+		Stability:       NewStability(),
+		Causal:          NewCausalBuffer(),
+		Sequencer:       NewSequencer(n, config.Sequencer == ElectedSequencer),
+		PubSub:          NewPubSub(),
+		Routes:          NewRoutes(),
+		Gossip:          NewGossip(),
+		Membership:      NewMembership(),
 		TopologyMutex:   &sync.Mutex{},
 		TopologyStorage: make(map[string][]string),
-		Ttl:             2,
-		BroadcastQueue:  make(map[string][]int),
+		Ttl:             env.Int("BROADCAST_TTL", 2),
+		BroadcastQueue:  make(map[string][]Entry),
+		InFlight:        make(map[string]*InFlightBatch),
 		BroadcastMutex:  sync.Mutex{},
 	}
+	h.Sequencer.Members = h.members
+	h.Sequencer.RPC = h.rpcWithTimeout
 	go h.BatchBroadcast()
+	go h.AdvertiseInterest()
+	go h.GossipStability()
+	go h.GossipMembership()
+	if config.Routing == LatencyRouting {
+		go h.Probe()
+	}
+	if config.Routing == GossipRouting {
+		go h.RunGossip()
+		go h.LogConvergence()
+	}
+	n.Handle("init", h.Init)
 	n.Handle("broadcast", h.Broadcast)
-	n.Handle("read", h.Read)
+	if config.Mode == GSetMode {
+		n.Handle("add", h.Add)
+		n.Handle("read", h.ReadSet)
+	} else {
+		n.Handle("read", h.Read)
+	}
 	n.Handle("topology", h.Topology)
+	n.Handle("queue_depth", h.QueueDepth)
+	n.Handle("stability", h.MergeStability)
+	n.Handle("publish", h.Publish)
+	n.Handle("subscribe", h.Subscribe)
+	n.Handle("fetch", h.Fetch)
+	n.Handle("interest", h.Interest)
+	n.Handle("ping", h.Ping)
+	n.Handle("join", h.Join)
+	n.Handle("leave", h.Leave)
+	n.Handle("membership", h.MergeMembership)
+	n.Handle("state_transfer", h.StateTransfer)
+	n.Handle("catch_up", h.CatchUp)
+	n.Handle("gossip", h.GossipPush)
+	n.Handle("arrivals", h.Arrivals)
+	n.Handle("convergence", h.Convergence)
+	if config.Mode == TotalOrder {
+		go h.Sequencer.Run()
+		n.Handle("order_append", h.Sequencer.Append)
+		n.Handle("order_vote", h.Sequencer.Vote)
+		n.Handle("ordered_read", h.Sequencer.OrderedRead)
+	}
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
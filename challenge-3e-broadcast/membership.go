@@ -0,0 +1,466 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/dedup"
+)
+
+type MemberState struct {
+	Member  bool `json:"member"`
+	Version int  `json:"version"`
+}
+
+// Membership is a last writer wins map of node to whether it belongs to the cluster. Every join or
+// leave bumps the node's version, and when two changes share a version the leave wins.
+type Membership struct {
+	Mutex   *sync.Mutex
+	Members map[string]MemberState
+	Joining bool // Set while this node is waiting for a state transfer after joining
+}
+
+func NewMembership() *Membership {
+	return &Membership{
+		Mutex:   &sync.Mutex{},
+		Members: make(map[string]MemberState),
+	}
+}
+
+// Merges states and returns the nodes whose membership changed
+func (m *Membership) Merge(states map[string]MemberState) []string {
+	changed := make([]string, 0)
+	for node, state := range states {
+		current, known := m.Members[node]
+		newer := state.Version > current.Version || state.Version == current.Version && current.Member && !state.Member
+		if known && !newer {
+			continue
+		}
+		if !known || current.Member != state.Member {
+			changed = append(changed, node)
+		}
+		m.Members[node] = state
+	}
+	return changed
+}
+
+// Returns the current members in the order Maelstrom listed them at init
+func (m *Membership) List(nodeIds []string) []string {
+	members := make([]string, 0, len(m.Members))
+	for _, node := range nodeIds {
+		if m.Members[node].Member {
+			members = append(members, node)
+		}
+	}
+	return members
+}
+
+func (m *Membership) copy() map[string]MemberState {
+	states := make(map[string]MemberState, len(m.Members))
+	for node, state := range m.Members {
+		states[node] = state
+	}
+	return states
+}
+
+// Every node Maelstrom started with is a member until told otherwise
+func (h *Handler) Init(msg maelstrom.Message) error {
+	h.Membership.Mutex.Lock()
+	for _, node := range h.Node.NodeIDs() {
+		h.Membership.Members[node] = MemberState{Member: true}
+	}
+	h.Membership.Mutex.Unlock()
+	h.rebuildTopology()
+	return nil
+}
+
+func (h *Handler) members() []string {
+	h.Membership.Mutex.Lock()
+	defer h.Membership.Mutex.Unlock()
+	return h.Membership.List(h.Node.NodeIDs())
+}
+
+func (h *Handler) isMember() (bool, bool) {
+	h.Membership.Mutex.Lock()
+	defer h.Membership.Mutex.Unlock()
+	return h.Membership.Members[h.Node.ID()].Member, h.Membership.Joining
+}
+
+// Admin RPC that adds a node to the cluster
+func (h *Handler) Join(msg maelstrom.Message) error {
+	return h.changeMembership(msg, true)
+}
+
+// Admin RPC that removes a node from the cluster
+func (h *Handler) Leave(msg maelstrom.Message) error {
+	return h.changeMembership(msg, false)
+}
+
+func (h *Handler) changeMembership(msg maelstrom.Message, member bool) error {
+	var body struct {
+		Type string `json:"type"`
+		Node string `json:"node"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if !slices.Contains(h.Node.NodeIDs(), body.Node) {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "unknown node "+body.Node)
+	}
+	h.Membership.Mutex.Lock()
+	state := MemberState{Member: member, Version: h.Membership.Members[body.Node].Version + 1}
+	changed := h.Membership.Merge(map[string]MemberState{body.Node: state})
+	states := h.Membership.copy()
+	h.Membership.Mutex.Unlock()
+	h.applyMembership(changed, h.Node.ID())
+	// Tell every node, members or not, so the node being added or removed hears about it too
+	for _, node := range h.Node.NodeIDs() {
+		if node != h.Node.ID() {
+			_ = h.Node.Send(node, map[string]any{
+				"type":    "membership",
+				"members": states,
+			})
+		}
+	}
+	return h.Node.Reply(msg, map[string]any{
+		"type": body.Type + "_ok",
+	})
+}
+
+// Periodically sends our membership table to our neighbors in case a change got lost
+func (h *Handler) GossipMembership() error {
+	for {
+		time.Sleep(2 * time.Second)
+		h.Membership.Mutex.Lock()
+		states := h.Membership.copy()
+		h.Membership.Mutex.Unlock()
+		h.TopologyMutex.Lock()
+		neighbors := h.TopologyStorage[h.Node.ID()]
+		h.TopologyMutex.Unlock()
+		for _, node := range neighbors {
+			_ = h.Node.Send(node, map[string]any{
+				"type":    "membership",
+				"members": states,
+			})
+		}
+	}
+}
+
+func (h *Handler) MergeMembership(msg maelstrom.Message) error {
+	var body struct {
+		Members map[string]MemberState `json:"members"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	h.Membership.Mutex.Lock()
+	changed := h.Membership.Merge(body.Members)
+	h.Membership.Mutex.Unlock()
+	h.applyMembership(changed, msg.Src)
+	return nil
+}
+
+// Updates the topology for every node whose membership changed, hands the queue of a departed hub
+// over to the remaining neighbors, and starts a state transfer if this node just joined
+func (h *Handler) applyMembership(changed []string, from string) {
+	if len(changed) == 0 {
+		return
+	}
+	h.Membership.Mutex.Lock()
+	members := h.Membership.List(h.Node.NodeIDs())
+	joined := false
+	for _, node := range changed {
+		if node == h.Node.ID() && h.Membership.Members[node].Member {
+			joined = true
+			h.Membership.Joining = true
+		}
+	}
+	h.Membership.Mutex.Unlock()
+
+	departed := make([]string, 0)
+	h.TopologyMutex.Lock()
+	previous := h.TopologyStorage[h.Node.ID()]
+	for _, node := range changed {
+		if slices.Contains(members, node) {
+			h.addToStar(members, node)
+		} else {
+			departed = append(departed, node)
+			h.removeFromStar(members, node)
+		}
+	}
+	neighbors := h.TopologyStorage[h.Node.ID()]
+	h.TopologyMutex.Unlock()
+
+	h.BroadcastMutex.Lock()
+	for _, node := range departed {
+		handover := h.BroadcastQueue[node]
+		delete(h.BroadcastQueue, node)
+		delete(h.InFlight, node)
+		// Only our hub was forwarding for us. A departed leaf's queue was meant for that leaf alone,
+		// and every other leaf has its own queue already.
+		if !slices.Equal(previous, []string{node}) {
+			continue
+		}
+		for _, neighbor := range neighbors {
+			for _, entry := range handover {
+				// The route ran through the departed node, so fall back to the star from here
+				entry.Route = nil
+				h.BroadcastQueue[neighbor] = append(h.BroadcastQueue[neighbor], entry)
+			}
+		}
+	}
+	h.BroadcastMutex.Unlock()
+
+	if !joined {
+		return
+	}
+	// Prefer whoever told us about the join, as it clearly knows the current state
+	if !slices.Contains(members, from) || from == h.Node.ID() {
+		from = ""
+		for _, member := range members {
+			if member != h.Node.ID() {
+				from = member
+				break
+			}
+		}
+	}
+	if from == "" {
+		h.Membership.Mutex.Lock()
+		h.Membership.Joining = false
+		h.Membership.Mutex.Unlock()
+		return
+	}
+	go h.transferState(from)
+}
+
+// Star topology around the first member. Must hold TopologyMutex.
+func (h *Handler) addToStar(members []string, node string) {
+	hub := members[0]
+	if node == hub {
+		h.buildStar(members)
+		return
+	}
+	if !slices.Contains(h.TopologyStorage[hub], node) {
+		h.TopologyStorage[hub] = append(h.TopologyStorage[hub], node)
+	}
+	h.TopologyStorage[node] = []string{hub}
+}
+
+// Must hold TopologyMutex
+func (h *Handler) removeFromStar(members []string, node string) {
+	wasLeaf := len(members) > 0 && slices.Equal(h.TopologyStorage[node], []string{members[0]})
+	delete(h.TopologyStorage, node)
+	if !wasLeaf {
+		// The hub itself left, so the star has to be rebuilt around the next member
+		h.buildStar(members)
+		return
+	}
+	hub := members[0]
+	remaining := make([]string, 0, len(h.TopologyStorage[hub]))
+	for _, neighbor := range h.TopologyStorage[hub] {
+		if neighbor != node {
+			remaining = append(remaining, neighbor)
+		}
+	}
+	h.TopologyStorage[hub] = remaining
+}
+
+// Must hold TopologyMutex
+func (h *Handler) buildStar(members []string) {
+	tree := make(map[string][]string)
+	if len(members) == 0 {
+		h.TopologyStorage = tree
+		return
+	}
+	for _, node := range members[1:] {
+		tree[members[0]] = append(tree[members[0]], node) // Add all nodes to the root node
+		tree[node] = append(tree[node], members[0])       // Add the root node to all nodes
+	}
+	h.TopologyStorage = tree
+}
+
+func (h *Handler) rebuildTopology() {
+	members := h.members()
+	h.TopologyMutex.Lock()
+	defer h.TopologyMutex.Unlock()
+	h.buildStar(members)
+}
+
+// Transfer is a member's stored state, sent to a node that joined. Causal mode adds the vector
+// clock and the entries still buffered, total order mode the delivered prefix and the payloads
+// still waiting for a slot.
+type Transfer struct {
+	Type       string         `json:"type"`
+	Checkpoint []any          `json:"checkpoint"`
+	Log        []Entry        `json:"log"`
+	Storage    *dedup.Set     `json:"storage"`
+	Delivered  map[string]int `json:"delivered,omitempty"`
+	Buffered   []Entry        `json:"buffered,omitempty"`
+	Ordered    []OrderedEntry `json:"ordered,omitempty"`
+	Payloads   []Entry        `json:"payloads,omitempty"`
+}
+
+// Copies a member's storage until it succeeds, then lets this node serve reads again
+func (h *Handler) transferState(from string) {
+	for {
+		reply, err := h.rpcWithTimeout(from, map[string]any{"type": "state_transfer"}, time.Second)
+		if err == nil {
+			var transfer Transfer
+			if err := json.Unmarshal(reply.Body, &transfer); err == nil {
+				h.installState(transfer)
+				h.catchUp()
+				h.Membership.Mutex.Lock()
+				h.Membership.Joining = false
+				h.Membership.Mutex.Unlock()
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Replaces our storage with a transferred one, keeping any entries we had that it lacks. Our own
+// checkpoint is dropped: everything in it was stored by every node, the sender included.
+func (h *Handler) installState(transfer Transfer) {
+	h.StorageMutex.Lock()
+	defer h.StorageMutex.Unlock()
+	snapshot := h.Messages.Load()
+	h.Storage = transfer.Storage
+	log := transfer.Log
+	switch h.Config.Mode {
+	case CausalMode:
+		// Our entries go back through the transferred buffer, so they only show up once their
+		// dependencies have
+		own := append(snapshot.Log, h.Causal.Buffered...)
+		h.Causal.Delivered = transfer.Delivered
+		if h.Causal.Delivered == nil {
+			h.Causal.Delivered = make(map[string]int)
+		}
+		h.Causal.Buffered = transfer.Buffered
+		for _, entry := range own {
+			if h.Storage.Add(entry.Origin, entry.Seq) {
+				log = append(log, h.Causal.Receive(entry)...)
+			}
+		}
+		h.Messages.Replace(transfer.Checkpoint, log, h.Causal.Clock())
+	case TotalOrder:
+		for _, entry := range snapshot.Log {
+			if h.Storage.Add(entry.Origin, entry.Seq) {
+				log = append(log, entry)
+			}
+		}
+		h.Messages.Replace(transfer.Checkpoint, log, nil)
+		// Our own entries already went through the sequencer, the transferred ones have not
+		h.Sequencer.Adopt(transfer.Ordered)
+		for _, entry := range append(transfer.Log, transfer.Payloads...) {
+			h.Sequencer.Receive(entry)
+		}
+	default:
+		for _, entry := range snapshot.Log {
+			if h.Storage.Add(entry.Origin, entry.Seq) {
+				log = append(log, entry)
+			}
+		}
+		h.Messages.Replace(transfer.Checkpoint, log, nil)
+	}
+}
+
+// Pulls whatever the hub stored that the transfer lacked. The sender may be a leaf the hub had not
+// forwarded everything to yet, and the hub only queues entries for us once it knows we joined.
+func (h *Handler) catchUp() {
+	for {
+		members := h.members()
+		if len(members) == 0 || members[0] == h.Node.ID() {
+			return
+		}
+		h.Membership.Mutex.Lock()
+		states := h.Membership.copy()
+		h.Membership.Mutex.Unlock()
+		h.StorageMutex.Lock()
+		digest, err := json.Marshal(h.Storage)
+		h.StorageMutex.Unlock()
+		if err != nil {
+			return
+		}
+		reply, err := h.rpcWithTimeout(members[0], map[string]any{
+			"type":    "catch_up",
+			"members": states,
+			"digest":  json.RawMessage(digest),
+		}, time.Second)
+		var body struct {
+			Entries []Entry `json:"entries"`
+		}
+		if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		h.StorageMutex.Lock()
+		h.ingest(body.Entries, reply.Src)
+		h.StorageMutex.Unlock()
+		// A full batch means there may be more
+		if len(body.Entries) < maxBatchSize {
+			return
+		}
+	}
+}
+
+// Answers a joined node's catch up with the entries it is missing. Its membership table comes
+// along, so the joiner is in our star before we look at the log: anything stored after that is
+// queued for it as usual.
+func (h *Handler) CatchUp(msg maelstrom.Message) error {
+	var body struct {
+		Members map[string]MemberState `json:"members"`
+		Digest  *dedup.Set             `json:"digest"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Digest == nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "catch_up needs a digest")
+	}
+	h.Membership.Mutex.Lock()
+	changed := h.Membership.Merge(body.Members)
+	h.Membership.Mutex.Unlock()
+	h.applyMembership(changed, msg.Src)
+	h.StorageMutex.Lock()
+	missing := h.missing(body.Digest)
+	// Buffered entries are not in the log yet, but were only ever queued for the old neighbors
+	for _, entry := range h.Causal.Buffered {
+		if len(missing) < maxBatchSize && !body.Digest.Seen(entry.Origin, entry.Seq) {
+			missing = append(missing, entry)
+		}
+	}
+	h.StorageMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type":    "catch_up_ok",
+		"entries": forwarded(missing),
+	})
+}
+
+func (h *Handler) StateTransfer(msg maelstrom.Message) error {
+	// The dedup state has to match the snapshot exactly, so hold StorageMutex while taking both
+	h.StorageMutex.Lock()
+	snapshot := h.Messages.Load()
+	transfer := Transfer{
+		Type:       "state_transfer_ok",
+		Checkpoint: snapshot.Checkpoint,
+		Log:        snapshot.Log,
+		Storage:    h.Storage,
+	}
+	switch h.Config.Mode {
+	case CausalMode:
+		transfer.Delivered = h.Causal.Clock()
+		transfer.Buffered = h.Causal.Buffered
+	case TotalOrder:
+		transfer.Ordered, transfer.Payloads = h.Sequencer.Transfer()
+	}
+	body, err := json.Marshal(transfer)
+	h.StorageMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return h.Node.Reply(msg, json.RawMessage(body))
+}
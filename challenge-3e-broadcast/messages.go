@@ -0,0 +1,78 @@
+package main
+
+import "sync/atomic"
+
+// Snapshot is an immutable view of everything stored at some point in time
+type Snapshot struct {
+	Checkpoint []any          // Payloads of the log prefix every node is known to have stored, compacted out of Log
+	Log        []Entry        // Entries in the order they were stored locally, after the checkpoint
+	Clock      map[string]int // Vector clock covering the log, only kept in causal mode
+}
+
+func (s *Snapshot) Len() int {
+	return len(s.Checkpoint) + len(s.Log)
+}
+
+// Returns the payloads stored from offset onwards, across the checkpoint and the log
+func (s *Snapshot) From(offset int) []any {
+	messages := make([]any, 0, s.Len()-offset)
+	if offset < len(s.Checkpoint) {
+		messages = append(messages, s.Checkpoint[offset:]...)
+	}
+	for _, entry := range s.Log[max(0, offset-len(s.Checkpoint)):] {
+		messages = append(messages, entry.Message)
+	}
+	return messages
+}
+
+// Messages publishes copy-on-write snapshots so that reads never wait for ingest. Writers must hold
+// StorageMutex. A new snapshot may share backing arrays with the one it replaces, as appends only
+// write past the end of the old slices, which no reader of the old snapshot ever looks at.
+type Messages struct {
+	current atomic.Pointer[Snapshot]
+}
+
+func NewMessages() *Messages {
+	m := &Messages{}
+	m.current.Store(&Snapshot{Clock: make(map[string]int)})
+	return m
+}
+
+func (m *Messages) Load() *Snapshot {
+	return m.current.Load()
+}
+
+// Appends entries to the log. A non-nil clock replaces the snapshot's vector clock in the same step.
+func (m *Messages) Append(entries []Entry, clock map[string]int) {
+	old := m.current.Load()
+	if clock == nil {
+		clock = old.Clock
+	}
+	m.current.Store(&Snapshot{
+		Checkpoint: old.Checkpoint,
+		Log:        append(old.Log, entries...),
+		Clock:      clock,
+	})
+}
+
+// Folds the first prefix entries of the log into the checkpoint
+func (m *Messages) Compact(prefix int) {
+	old := m.current.Load()
+	m.current.Store(&Snapshot{
+		Checkpoint: append(old.Checkpoint, payloads(old.Log[:prefix])...),
+		Log:        append([]Entry(nil), old.Log[prefix:]...),
+		Clock:      old.Clock,
+	})
+}
+
+// Replaces everything stored. A non-nil clock replaces the vector clock too, as in Append.
+func (m *Messages) Replace(checkpoint []any, log []Entry, clock map[string]int) {
+	if clock == nil {
+		clock = m.current.Load().Clock
+	}
+	m.current.Store(&Snapshot{
+		Checkpoint: checkpoint,
+		Log:        log,
+		Clock:      clock,
+	})
+}
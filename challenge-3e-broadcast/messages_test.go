@@ -0,0 +1,140 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	benchmarkStored = 10000 // Messages stored before reads start
+	benchmarkBatch  = 16    // Entries per ingested batch
+)
+
+// benchmarkStore is what the read benchmark needs from either way of storing messages. Ingest has
+// to be rolled back now and then, or the log would grow for as long as the benchmark runs.
+type benchmarkStore interface {
+	ingest(entries []Entry) int
+	reset(log []Entry)
+	read() int
+}
+
+// snapshotStore is the current way: writers take StorageMutex, reads only load a snapshot
+type snapshotStore struct {
+	storage  sync.Mutex
+	messages *Messages
+}
+
+func (s *snapshotStore) ingest(entries []Entry) int {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	s.messages.Append(entries, nil)
+	return s.messages.Load().Len()
+}
+
+func (s *snapshotStore) reset(log []Entry) {
+	s.storage.Lock()
+	defer s.storage.Unlock()
+	s.messages.Replace(nil, slices.Clip(log), nil)
+}
+
+func (s *snapshotStore) read() int {
+	return len(s.messages.Load().From(0))
+}
+
+// lockedStore is how messages were stored before snapshots: a single log behind the storage lock,
+// which ingest and every read took in turn
+type lockedStore struct {
+	mutex sync.Mutex
+	log   []Entry
+}
+
+func (l *lockedStore) ingest(entries []Entry) int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.log = append(l.log, entries...)
+	return len(l.log)
+}
+
+func (l *lockedStore) reset(log []Entry) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.log = slices.Clip(log)
+}
+
+func (l *lockedStore) read() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(payloads(l.log))
+}
+
+func benchmarkEntries(origin string, count int) []Entry {
+	entries := make([]Entry, count)
+	for i := range entries {
+		entries[i] = Entry{Origin: origin, Seq: i + 1, Message: i}
+	}
+	return entries
+}
+
+// Runs parallel reads while one goroutine keeps ingesting batches. The timer only starts once the
+// first batch is in, so ingest is known to be running alongside the reads even with -cpu 1.
+// Besides the read time, reports how many batches went in during the reads, how long one took on
+// average and at worst, i.e. how much reads held ingest up.
+func benchmarkReads(b *testing.B, store benchmarkStore) {
+	stored := benchmarkEntries("n0", benchmarkStored)
+	store.reset(stored)
+	batch := benchmarkEntries("n1", benchmarkBatch)
+	var ingested int
+	var total, slowest time.Duration
+	started := make(chan struct{})
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			start := time.Now()
+			if store.ingest(batch) > 2*benchmarkStored {
+				store.reset(stored)
+			}
+			elapsed := time.Since(start)
+			if ingested == 0 {
+				close(started)
+			}
+			ingested++
+			total += elapsed
+			slowest = max(slowest, elapsed)
+		}
+	}()
+	<-started
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if store.read() < benchmarkStored {
+				b.Error("read lost messages")
+			}
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+	b.ReportMetric(float64(ingested), "batches")
+	b.ReportMetric(float64(total.Nanoseconds())/float64(ingested), "ingest-ns/batch")
+	b.ReportMetric(float64(slowest.Nanoseconds()), "ingest-max-ns")
+}
+
+// Compares reads off copy-on-write snapshots with reads that take the storage lock, with ingest
+// running the whole time. Run with go test -run - -bench Reads -cpu 1,4,8.
+func BenchmarkReads(b *testing.B) {
+	b.Run("snapshot", func(b *testing.B) {
+		benchmarkReads(b, &snapshotStore{messages: NewMessages()})
+	})
+	b.Run("mutex", func(b *testing.B) {
+		benchmarkReads(b, &lockedStore{})
+	})
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// PubSub tracks topic subscriptions. Every node tells each neighbor which topics have subscribers
+// reachable through it (its own subscriptions plus whatever its other neighbors told it), so a
+// publication is only forwarded down links that lead to a subscriber.
+type PubSub struct {
+	Mutex         *sync.Mutex
+	Subscriptions map[string]struct{}
+	Interest      map[string]map[string]struct{} // Topics each neighbor has subscribers behind
+	Advertised    map[string]string              // Interest each neighbor last acknowledged, as a sorted key
+	Topics        map[string][]any               // Publications stored for local subscribers, per topic
+	NextSeq       map[string]int                 // Sequence number for the next publication from this node, per topic
+	// Highest sequence number received per origin and topic. Publications only travel down links with
+	// interest, so a node sees gaps in each stream, but each link delivers a stream in order.
+	Streams map[string]int
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		Mutex:         &sync.Mutex{},
+		Subscriptions: make(map[string]struct{}),
+		Interest:      make(map[string]map[string]struct{}),
+		Advertised:    make(map[string]string),
+		Topics:        make(map[string][]any),
+		NextSeq:       make(map[string]int),
+		Streams:       make(map[string]int),
+	}
+}
+
+// Records a publication and returns false if it had already been received
+func (p *PubSub) Accept(entry Entry) bool {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	stream := entry.Origin + "/" + entry.Topic
+	if entry.Seq <= p.Streams[stream] {
+		return false
+	}
+	p.Streams[stream] = entry.Seq
+	return true
+}
+
+// Keeps a publication if this node has a subscriber for its topic
+func (p *PubSub) Store(entry Entry) {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	if _, subscribed := p.Subscriptions[entry.Topic]; subscribed {
+		p.Topics[entry.Topic] = append(p.Topics[entry.Topic], entry.Message)
+	}
+}
+
+func (p *PubSub) Interested(node string, topic string) bool {
+	p.Mutex.Lock()
+	defer p.Mutex.Unlock()
+	_, interested := p.Interest[node][topic]
+	return interested
+}
+
+// The topics to advertise to a neighbor: everything subscribed here or behind any other neighbor
+func (p *PubSub) interestFor(node string) []string {
+	topics := make(map[string]struct{}, len(p.Subscriptions))
+	for topic := range p.Subscriptions {
+		topics[topic] = struct{}{}
+	}
+	for neighbor, interest := range p.Interest {
+		if neighbor == node {
+			continue
+		}
+		for topic := range interest {
+			topics[topic] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(topics))
+	for topic := range topics {
+		sorted = append(sorted, topic)
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// Periodically sends each neighbor our interest until it acknowledges the latest version
+func (h *Handler) AdvertiseInterest() error {
+	for {
+		time.Sleep(500 * time.Millisecond)
+		h.TopologyMutex.Lock()
+		neighbors := h.TopologyStorage[h.Node.ID()]
+		h.TopologyMutex.Unlock()
+		h.PubSub.Mutex.Lock()
+		for _, node := range neighbors {
+			topics := h.PubSub.interestFor(node)
+			key := strings.Join(topics, "\x00")
+			if h.PubSub.Advertised[node] == key {
+				continue
+			}
+			_ = h.Node.RPC(node, map[string]any{
+				"type":   "interest",
+				"topics": topics,
+			}, func(_ maelstrom.Message) error {
+				h.PubSub.Mutex.Lock()
+				defer h.PubSub.Mutex.Unlock()
+				h.PubSub.Advertised[node] = key
+				return nil
+			})
+		}
+		h.PubSub.Mutex.Unlock()
+	}
+}
+
+// Replaces the set of topics the sender has subscribers behind
+func (h *Handler) Interest(msg maelstrom.Message) error {
+	var body struct {
+		Topics []string `json:"topics"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	interest := make(map[string]struct{}, len(body.Topics))
+	for _, topic := range body.Topics {
+		interest[topic] = struct{}{}
+	}
+	h.PubSub.Mutex.Lock()
+	h.PubSub.Interest[msg.Src] = interest
+	h.PubSub.Mutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type": "interest_ok",
+	})
+}
+
+func (h *Handler) Publish(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	topic, ok := body["topic"].(string)
+	if !ok || topic == "" {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "topic must be a non-empty string")
+	}
+	if h.queueFull(1, msg.Src) {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "broadcast queues are full")
+	}
+	h.StorageMutex.Lock()
+	h.PubSub.Mutex.Lock()
+	h.PubSub.NextSeq[topic]++
+	entry := Entry{Origin: h.Node.ID(), Seq: h.PubSub.NextSeq[topic], Message: body["payload"], Topic: topic, Ttl: h.Ttl}
+	h.PubSub.Mutex.Unlock()
+	h.ingest([]Entry{entry}, msg.Src)
+	h.StorageMutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type": "publish_ok",
+	})
+}
+
+// Subscribes this node to a topic. Only publications made after the subscription has been
+// gossiped to the publisher are guaranteed to arrive.
+func (h *Handler) Subscribe(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	topic, ok := body["topic"].(string)
+	if !ok || topic == "" {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "topic must be a non-empty string")
+	}
+	h.PubSub.Mutex.Lock()
+	h.PubSub.Subscriptions[topic] = struct{}{}
+	offset := len(h.PubSub.Topics[topic])
+	h.PubSub.Mutex.Unlock()
+	return h.Node.Reply(msg, map[string]any{
+		"type":   "subscribe_ok",
+		"offset": offset,
+	})
+}
+
+// Returns the publications stored for a topic from offset since onwards
+func (h *Handler) Fetch(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	topic, ok := body["topic"].(string)
+	if !ok {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "topic must be a string")
+	}
+	since := 0
+	if body["since"] != nil {
+		offset, ok := body["since"].(float64)
+		if !ok {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, "since must be a number")
+		}
+		since = int(offset)
+	}
+	h.PubSub.Mutex.Lock()
+	defer h.PubSub.Mutex.Unlock()
+	if _, subscribed := h.PubSub.Subscriptions[topic]; !subscribed {
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "not subscribed to "+topic)
+	}
+	stored := h.PubSub.Topics[topic]
+	if since < 0 || since > len(stored) {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "since is out of range")
+	}
+	messages := make([]any, len(stored)-since)
+	copy(messages, stored[since:])
+	return h.Node.Reply(msg, map[string]any{
+		"type":     "fetch_ok",
+		"messages": messages,
+		"next":     len(stored),
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	StarRouting    = "star"    // Forward to topology neighbors, every link is treated as equal
+	LatencyRouting = "latency" // Forward along a shortest path tree built from measured round trips
+	GossipRouting  = "gossip"  // Don't forward, push-pull with random peers every round instead
+
+	rttSmoothing = 0.2 // Weight of a new sample in the moving average of a link's round trip
+)
+
+// Routes holds every node's smoothed round trip times to its peers. Each node measures its own
+// links from pings and batch acks, and learns everybody else's from the pings they send it.
+type Routes struct {
+	Mutex *sync.Mutex
+	Rtt   map[string]map[string]float64 // Rtt[a][b] is a's measured round trip to b, in milliseconds
+}
+
+func NewRoutes() *Routes {
+	return &Routes{
+		Mutex: &sync.Mutex{},
+		Rtt:   make(map[string]map[string]float64),
+	}
+}
+
+func (r *Routes) Observe(self string, peer string, rtt time.Duration) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Rtt[self] == nil {
+		r.Rtt[self] = make(map[string]float64)
+	}
+	sample := float64(rtt) / float64(time.Millisecond)
+	if previous, exists := r.Rtt[self][peer]; exists {
+		sample = previous + rttSmoothing*(sample-previous)
+	}
+	r.Rtt[self][peer] = sample
+}
+
+// Returns a copy of the round trips measured by node
+func (r *Routes) Measured(node string) map[string]float64 {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	rtts := make(map[string]float64, len(r.Rtt[node]))
+	for peer, rtt := range r.Rtt[node] {
+		rtts[peer] = rtt
+	}
+	return rtts
+}
+
+func (r *Routes) Learn(node string, rtts map[string]float64) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.Rtt[node] = rtts
+}
+
+// Builds the minimum latency tree rooted at origin with Dijkstra, as a map of each node to its children.
+// A link measured in only one direction uses that measurement, and a node no measured link reaches
+// hangs directly off the origin. Returns nil until the origin has measured anything.
+func (r *Routes) Tree(origin string, nodes []string) map[string][]string {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if len(r.Rtt[origin]) == 0 {
+		return nil
+	}
+	dist := map[string]float64{origin: 0}
+	parent := make(map[string]string)
+	done := make(map[string]struct{})
+	for len(done) < len(dist) {
+		closest := ""
+		for node, d := range dist {
+			if _, finished := done[node]; !finished && (closest == "" || d < dist[closest] || d == dist[closest] && node < closest) {
+				closest = node
+			}
+		}
+		done[closest] = struct{}{}
+		for _, node := range nodes {
+			rtt, ok := r.link(closest, node)
+			if _, finished := done[node]; finished || !ok {
+				continue
+			}
+			if d, seen := dist[node]; !seen || dist[closest]+rtt < d {
+				dist[node] = dist[closest] + rtt
+				parent[node] = closest
+			}
+		}
+	}
+	tree := make(map[string][]string)
+	for _, node := range nodes {
+		if node == origin {
+			continue
+		}
+		if _, reached := parent[node]; !reached {
+			parent[node] = origin
+		}
+		tree[parent[node]] = append(tree[parent[node]], node)
+	}
+	for _, children := range tree {
+		sort.Strings(children)
+	}
+	return tree
+}
+
+func (r *Routes) link(from string, to string) (float64, bool) {
+	if rtt, ok := r.Rtt[from][to]; ok {
+		return rtt, true
+	}
+	rtt, ok := r.Rtt[to][from]
+	return rtt, ok
+}
+
+// Returns the part of tree below root, which is the route handed to root along with an entry.
+// Root always has a key, even as a leaf, so that an empty route is distinguishable from no route.
+func subtree(tree map[string][]string, root string) map[string][]string {
+	route := map[string][]string{root: tree[root]}
+	pending := []string{root}
+	for len(pending) > 0 {
+		node := pending[0]
+		pending = pending[1:]
+		if children := tree[node]; len(children) > 0 {
+			route[node] = children
+			pending = append(pending, children...)
+		}
+	}
+	return route
+}
+
+// Returns the number of hops from root to the deepest node of tree
+func depth(tree map[string][]string, root string) int {
+	deepest := 0
+	for _, child := range tree[root] {
+		deepest = max(deepest, depth(tree, child)+1)
+	}
+	return deepest
+}
+
+// Periodically pings every other node to measure round trips, sharing our own measurements with them
+func (h *Handler) Probe() error {
+	for {
+		time.Sleep(h.Config.PingInterval)
+		if h.Node.ID() == "" {
+			continue
+		}
+		rtts := h.Routes.Measured(h.Node.ID())
+		for _, node := range h.members() {
+			if node == h.Node.ID() {
+				continue
+			}
+			sent := time.Now()
+			_ = h.Node.RPC(node, map[string]any{
+				"type": "ping",
+				"rtts": rtts,
+			}, func(_ maelstrom.Message) error {
+				h.Routes.Observe(h.Node.ID(), node, time.Since(sent))
+				return nil
+			})
+		}
+	}
+}
+
+func (h *Handler) Ping(msg maelstrom.Message) error {
+	var body struct {
+		Rtts map[string]float64 `json:"rtts"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	h.Routes.Learn(msg.Src, body.Rtts)
+	return h.Node.Reply(msg, map[string]any{
+		"type": "ping_ok",
+	})
+}
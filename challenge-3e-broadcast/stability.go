@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Stability is a matrix clock of dedup watermarks: Known[node][origin] means node is known to have
+// stored every entry from origin up to that sequence number. Rows only ever grow, so merging is an
+// element-wise max, and the minimum of a column is what every node has stored from that origin.
+type Stability struct {
+	Known map[string]map[string]int
+}
+
+func NewStability() *Stability {
+	return &Stability{
+		Known: make(map[string]map[string]int),
+	}
+}
+
+func (s *Stability) Merge(known map[string]map[string]int) {
+	for node, watermarks := range known {
+		if s.Known[node] == nil {
+			s.Known[node] = make(map[string]int, len(watermarks))
+		}
+		for origin, seq := range watermarks {
+			s.Known[node][origin] = max(s.Known[node][origin], seq)
+		}
+	}
+}
+
+// Returns, for each origin, the sequence number up to which every one of nodes has stored its entries
+func (s *Stability) Stable(nodes []string) map[string]int {
+	stable := make(map[string]int)
+	if len(nodes) == 0 {
+		return stable
+	}
+	for origin, seq := range s.Known[nodes[0]] {
+		stable[origin] = seq
+	}
+	for _, node := range nodes[1:] {
+		for origin, seq := range stable {
+			stable[origin] = min(seq, s.Known[node][origin])
+		}
+	}
+	return stable
+}
+
+func (s *Stability) copy() map[string]map[string]int {
+	known := make(map[string]map[string]int, len(s.Known))
+	for node, watermarks := range s.Known {
+		known[node] = make(map[string]int, len(watermarks))
+		for origin, seq := range watermarks {
+			known[node][origin] = seq
+		}
+	}
+	return known
+}
+
+// Periodically sends our view of everyone's watermarks to our neighbors, so that it spreads
+// through the topology the same way entries do
+func (h *Handler) GossipStability() error {
+	for {
+		time.Sleep(time.Second)
+		h.StorageMutex.Lock()
+		h.Stability.Merge(map[string]map[string]int{h.Node.ID(): h.Storage.Watermarks})
+		known := h.Stability.copy()
+		h.StorageMutex.Unlock()
+		h.TopologyMutex.Lock()
+		neighbors := h.TopologyStorage[h.Node.ID()]
+		h.TopologyMutex.Unlock()
+		for _, node := range neighbors {
+			_ = h.Node.Send(node, map[string]any{
+				"type":  "stability",
+				"known": known,
+			})
+		}
+	}
+}
+
+// Merges a neighbor's view of everyone's watermarks and compacts whatever became stable
+func (h *Handler) MergeStability(msg maelstrom.Message) error {
+	var body struct {
+		Known map[string]map[string]int `json:"known"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	h.StorageMutex.Lock()
+	defer h.StorageMutex.Unlock()
+	h.Stability.Merge(body.Known)
+	h.Stability.Merge(map[string]map[string]int{h.Node.ID(): h.Storage.Watermarks})
+	h.compact(h.Stability.Stable(h.members()))
+	return nil
+}
+
+// Folds the longest prefix of the log that every node has stored into the checkpoint, dropping
+// its metadata and gossip arrivals, and stops retrying entries that every node already has
+func (h *Handler) compact(stable map[string]int) {
+	log := h.Messages.Load().Log
+	prefix := 0
+	for prefix < len(log) && log[prefix].Seq <= stable[log[prefix].Origin] {
+		prefix++
+	}
+	if prefix > 0 {
+		h.Messages.Compact(prefix)
+		h.Gossip.Forget(log[:prefix])
+	}
+
+	h.BroadcastMutex.Lock()
+	defer h.BroadcastMutex.Unlock()
+	for node, entries := range h.BroadcastQueue {
+		// The front of the queue may be in flight and gets trimmed by position once acked, so leave it alone
+		start := 0
+		if batch := h.InFlight[node]; batch != nil {
+			start = batch.Size
+		}
+		kept := entries[:start:start]
+		for _, entry := range entries[start:] {
+			if entry.Topic != "" || entry.Seq > stable[entry.Origin] {
+				kept = append(kept, entry)
+			}
+		}
+		h.BroadcastQueue[node] = kept
+	}
+}
@@ -1,9 +1,17 @@
 #!/bin/bash
+# Usage: ./test.sh [mode] [extra maelstrom args], e.g. ./test.sh causal --nemesis partition
+# The g-set mode runs the g-set workload, e.g. ./test.sh g-set --nemesis partition
 
 maelstrom_path="../maelstrom"  
 cwd=$(pwd)
+mode=${1:-batch}
+shift $(( $# > 0 ? 1 : 0 ))
+workload=broadcast
+if [ "$mode" = "g-set" ]; then
+    workload=g-set
+fi
 
 go build -o bin
 cd "$maelstrom_path" || exit
-./maelstrom test -w broadcast --bin $cwd/bin --node-count 25 --time-limit 20 --rate 100 --latency 100
+BROADCAST_MODE=$mode ./maelstrom test -w $workload --bin $cwd/bin --node-count 25 --time-limit 20 --rate 100 --latency 100 "$@"
 cd "$cwd" || exit
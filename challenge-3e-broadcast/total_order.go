@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"slices"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	FixedSequencer   = "fixed"   // The first node orders every entry and never changes
+	ElectedSequencer = "elected" // The sequencer is elected, and re-elected when it fails, Raft style
+
+	sequencerTick     = 100 * time.Millisecond
+	sequencerTimeout  = time.Second // How long an order_append or order_vote waits for its reply
+	maxSlotsPerAppend = 256
+)
+
+const (
+	follower = iota
+	candidate
+	leader
+)
+
+type EntryId struct {
+	Origin string
+	Seq    int
+}
+
+// A position in the total order. Slots with an empty origin are no-ops a new leader appends
+// so that it can commit the slots left behind by previous terms.
+type OrderSlot struct {
+	Term   int    `json:"term"`
+	Origin string `json:"origin"`
+	Seq    int    `json:"seq"`
+}
+
+type OrderedEntry struct {
+	Seq     int    `json:"seq"`
+	Origin  string `json:"origin"`
+	Message any    `json:"message"`
+}
+
+// Sequencer assigns every broadcast entry a position in a single log shared by all nodes, and
+// delivers entries in log order once their slot is committed and their payload has arrived.
+// Payloads still travel over the regular gossip, only the (origin, seq) ids go through the log.
+type Sequencer struct {
+	Node  *maelstrom.Node
+	Elect bool
+	Mutex *sync.Mutex
+	// The current members, which make up the group that orders entries, and how to reach them.
+	// Both come from the broadcast handler once it exists.
+	Members func() []string
+	RPC     func(node string, body map[string]any, timeout time.Duration) (maelstrom.Message, error)
+
+	Role      int
+	Term      int
+	VotedFor  string
+	Votes     map[string]struct{}
+	LastHeard time.Time
+	Timeout   time.Duration
+
+	Slots       []OrderSlot // Slot i (1-based) is Slots[i-1]
+	CommitIndex int
+	Ordered     map[EntryId]int      // Slot index, counting from 1, of every id present in Slots
+	Unordered   map[EntryId]struct{} // Ids we have a payload for that are not in Slots yet
+	Payloads    map[EntryId]Entry    // Entries stored here that have not been delivered yet
+	Delivered   []OrderedEntry
+	NextIndex   map[string]int
+	MatchIndex  map[string]int
+	// Members with an order_append in flight. They get no other until it is answered or times out,
+	// as Maelstrom keeps the callback of every RPC that never gets a reply.
+	Waiting map[string]struct{}
+}
+
+func NewSequencer(n *maelstrom.Node, elect bool) *Sequencer {
+	return &Sequencer{
+		Node:       n,
+		Elect:      elect,
+		Mutex:      &sync.Mutex{},
+		Votes:      make(map[string]struct{}),
+		Timeout:    electionTimeout(),
+		Ordered:    make(map[EntryId]int),
+		Unordered:  make(map[EntryId]struct{}),
+		Payloads:   make(map[EntryId]Entry),
+		NextIndex:  make(map[string]int),
+		MatchIndex: make(map[string]int),
+		Waiting:    make(map[string]struct{}),
+	}
+}
+
+func electionTimeout() time.Duration {
+	return time.Second + time.Duration(rand.Int63n(int64(time.Second)))
+}
+
+// Hands a newly stored entry to the sequencer
+func (s *Sequencer) Receive(entry Entry) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	id := EntryId{Origin: entry.Origin, Seq: entry.Seq}
+	index, ordered := s.Ordered[id]
+	if ordered && index <= len(s.Delivered) {
+		return
+	}
+	s.Payloads[id] = entry
+	if !ordered {
+		s.Unordered[id] = struct{}{}
+	}
+	s.deliver()
+}
+
+// Takes over a longer delivered prefix from another node, for a node that joined and missed the
+// payloads it needs to deliver it. Committed slots are the same everywhere, so so are the prefixes.
+func (s *Sequencer) Adopt(delivered []OrderedEntry) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	if len(delivered) <= len(s.Delivered) {
+		return
+	}
+	s.Delivered = delivered
+	for id := range s.Payloads {
+		if index, ordered := s.Ordered[id]; ordered && index <= len(s.Delivered) {
+			delete(s.Payloads, id)
+		}
+	}
+	s.deliver()
+}
+
+// Returns the delivered prefix and the payloads still waiting for their slot, for a state transfer
+func (s *Sequencer) Transfer() ([]OrderedEntry, []Entry) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	payloads := make([]Entry, 0, len(s.Payloads))
+	for _, entry := range s.Payloads {
+		payloads = append(payloads, entry)
+	}
+	return append([]OrderedEntry(nil), s.Delivered...), payloads
+}
+
+func (s *Sequencer) Run() {
+	for {
+		time.Sleep(sequencerTick)
+		s.Mutex.Lock()
+		members := s.Members()
+		if s.Node.ID() == "" || !slices.Contains(members, s.Node.ID()) {
+			// A node that left neither leads nor stands for election
+			s.Role = follower
+			s.Mutex.Unlock()
+			continue
+		}
+		if !s.Elect && s.Role != leader && members[0] == s.Node.ID() {
+			s.becomeLeader(members)
+		}
+		if s.Role == leader {
+			s.sequence()
+			s.replicate(members)
+		} else if s.Elect && time.Since(s.LastHeard) > s.Timeout {
+			s.startElection(members)
+		}
+		s.Mutex.Unlock()
+	}
+}
+
+func (s *Sequencer) becomeLeader(members []string) {
+	s.Role = leader
+	for _, node := range members {
+		s.NextIndex[node] = len(s.Slots) + 1
+		s.MatchIndex[node] = 0
+	}
+	if s.Elect {
+		s.Slots = append(s.Slots, OrderSlot{Term: s.Term})
+	}
+}
+
+func (s *Sequencer) becomeFollower(term int) {
+	if term > s.Term {
+		s.Term = term
+		s.VotedFor = ""
+	}
+	s.Role = follower
+	s.LastHeard = time.Now()
+}
+
+// Gives every entry the leader knows about but has not ordered yet a slot
+func (s *Sequencer) sequence() {
+	for id := range s.Unordered {
+		s.Slots = append(s.Slots, OrderSlot{Term: s.Term, Origin: id.Origin, Seq: id.Seq})
+		s.Ordered[id] = len(s.Slots)
+		delete(s.Unordered, id)
+	}
+	if !s.Elect {
+		s.CommitIndex = len(s.Slots)
+		s.deliver()
+	}
+}
+
+// Sends every member that isn't waiting on one already the slots it is missing
+func (s *Sequencer) replicate(members []string) {
+	for _, node := range members {
+		if _, waiting := s.Waiting[node]; waiting || node == s.Node.ID() {
+			continue
+		}
+		// A member that joined after this node became leader starts from the end, like the rest did
+		if _, known := s.NextIndex[node]; !known {
+			s.NextIndex[node] = len(s.Slots) + 1
+		}
+		prevIndex := s.NextIndex[node] - 1
+		prevTerm := 0
+		if prevIndex > 0 {
+			prevTerm = s.Slots[prevIndex-1].Term
+		}
+		end := min(len(s.Slots), prevIndex+maxSlotsPerAppend)
+		slots := make([]OrderSlot, end-prevIndex)
+		copy(slots, s.Slots[prevIndex:end])
+		term, commit := s.Term, s.CommitIndex
+		s.Waiting[node] = struct{}{}
+		go func() {
+			reply, err := s.RPC(node, map[string]any{
+				"type":       "order_append",
+				"term":       term,
+				"prev_index": prevIndex,
+				"prev_term":  prevTerm,
+				"slots":      slots,
+				"commit":     commit,
+			}, sequencerTimeout)
+			s.Mutex.Lock()
+			defer s.Mutex.Unlock()
+			delete(s.Waiting, node)
+			var body struct {
+				Term    int  `json:"term"`
+				Success bool `json:"success"`
+				Match   int  `json:"match"`
+			}
+			if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+				return
+			}
+			if body.Term > s.Term {
+				s.becomeFollower(body.Term)
+				return
+			}
+			if s.Role != leader || term != s.Term {
+				return
+			}
+			if body.Success {
+				s.MatchIndex[node] = max(s.MatchIndex[node], body.Match)
+				s.NextIndex[node] = s.MatchIndex[node] + 1
+				s.advanceCommit()
+				return
+			}
+			s.NextIndex[node] = max(1, min(s.NextIndex[node]-1, body.Match+1))
+		}()
+	}
+}
+
+// Commits the highest slot of the current term that a majority has stored
+func (s *Sequencer) advanceCommit() {
+	nodes := s.Members()
+	for index := len(s.Slots); index > s.CommitIndex; index-- {
+		if s.Slots[index-1].Term != s.Term {
+			break
+		}
+		replicas := 1
+		for _, node := range nodes {
+			if node != s.Node.ID() && s.MatchIndex[node] >= index {
+				replicas++
+			}
+		}
+		if replicas > len(nodes)/2 {
+			s.CommitIndex = index
+			s.deliver()
+			return
+		}
+	}
+}
+
+// Delivers committed slots in order, stopping at the first one whose payload has not arrived yet.
+// A delivered payload is dropped, as Delivered keeps everything ordered_read needs.
+func (s *Sequencer) deliver() {
+	for len(s.Delivered) < s.CommitIndex {
+		slot := s.Slots[len(s.Delivered)]
+		if slot.Origin == "" {
+			s.Delivered = append(s.Delivered, OrderedEntry{Seq: len(s.Delivered) + 1})
+			continue
+		}
+		id := EntryId{Origin: slot.Origin, Seq: slot.Seq}
+		entry, exists := s.Payloads[id]
+		if !exists {
+			return
+		}
+		delete(s.Payloads, id)
+		s.Delivered = append(s.Delivered, OrderedEntry{Seq: len(s.Delivered) + 1, Origin: entry.Origin, Message: entry.Message})
+	}
+}
+
+func (s *Sequencer) startElection(members []string) {
+	s.Role = candidate
+	s.Term++
+	s.VotedFor = s.Node.ID()
+	s.Votes = map[string]struct{}{s.Node.ID(): {}}
+	s.LastHeard = time.Now()
+	s.Timeout = electionTimeout()
+	lastIndex, lastTerm := s.lastSlot()
+	term := s.Term
+	for _, node := range members {
+		if node == s.Node.ID() {
+			continue
+		}
+		go func() {
+			reply, err := s.RPC(node, map[string]any{
+				"type":       "order_vote",
+				"term":       term,
+				"last_index": lastIndex,
+				"last_term":  lastTerm,
+			}, sequencerTimeout)
+			var body struct {
+				Term    int  `json:"term"`
+				Granted bool `json:"granted"`
+			}
+			if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+				return
+			}
+			s.Mutex.Lock()
+			defer s.Mutex.Unlock()
+			if body.Term > s.Term {
+				s.becomeFollower(body.Term)
+				return
+			}
+			if s.Role != candidate || term != s.Term || !body.Granted {
+				return
+			}
+			s.Votes[node] = struct{}{}
+			// Votes from nodes that left since don't count
+			current := s.Members()
+			votes := 0
+			for voter := range s.Votes {
+				if slices.Contains(current, voter) {
+					votes++
+				}
+			}
+			if votes > len(current)/2 {
+				s.becomeLeader(current)
+			}
+		}()
+	}
+}
+
+func (s *Sequencer) lastSlot() (int, int) {
+	if len(s.Slots) == 0 {
+		return 0, 0
+	}
+	return len(s.Slots), s.Slots[len(s.Slots)-1].Term
+}
+
+func (s *Sequencer) Vote(msg maelstrom.Message) error {
+	var body struct {
+		Term      int `json:"term"`
+		LastIndex int `json:"last_index"`
+		LastTerm  int `json:"last_term"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	// Step down without resetting the election timer, so a candidate with a stale log can't hold elections off
+	if body.Term > s.Term {
+		s.Term = body.Term
+		s.VotedFor = ""
+		s.Role = follower
+	}
+	lastIndex, lastTerm := s.lastSlot()
+	upToDate := body.LastTerm > lastTerm || body.LastTerm == lastTerm && body.LastIndex >= lastIndex
+	granted := body.Term == s.Term && (s.VotedFor == "" || s.VotedFor == msg.Src) && upToDate
+	if granted {
+		s.VotedFor = msg.Src
+		s.LastHeard = time.Now()
+	}
+	return s.Node.Reply(msg, map[string]any{
+		"type":    "order_vote_ok",
+		"term":    s.Term,
+		"granted": granted,
+	})
+}
+
+func (s *Sequencer) Append(msg maelstrom.Message) error {
+	var body struct {
+		Term      int         `json:"term"`
+		PrevIndex int         `json:"prev_index"`
+		PrevTerm  int         `json:"prev_term"`
+		Slots     []OrderSlot `json:"slots"`
+		Commit    int         `json:"commit"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	reply := map[string]any{
+		"type":    "order_append_ok",
+		"term":    s.Term,
+		"success": false,
+		"match":   len(s.Slots),
+	}
+	if body.Term < s.Term {
+		return s.Node.Reply(msg, reply)
+	}
+	s.becomeFollower(body.Term)
+	reply["term"] = s.Term
+	if body.PrevIndex > len(s.Slots) || body.PrevIndex > 0 && s.Slots[body.PrevIndex-1].Term != body.PrevTerm {
+		reply["match"] = min(len(s.Slots), body.PrevIndex-1)
+		return s.Node.Reply(msg, reply)
+	}
+	for i, slot := range body.Slots {
+		index := body.PrevIndex + i + 1
+		if index <= len(s.Slots) {
+			if s.Slots[index-1].Term == slot.Term {
+				continue
+			}
+			s.truncate(index)
+		}
+		s.Slots = append(s.Slots, slot)
+		if slot.Origin != "" {
+			id := EntryId{Origin: slot.Origin, Seq: slot.Seq}
+			s.Ordered[id] = index
+			delete(s.Unordered, id)
+			// Delivered already, in a prefix adopted from another node
+			if index <= len(s.Delivered) {
+				delete(s.Payloads, id)
+			}
+		}
+	}
+	match := body.PrevIndex + len(body.Slots)
+	if commit := min(body.Commit, match); commit > s.CommitIndex {
+		s.CommitIndex = commit
+		s.deliver()
+	}
+	reply["success"] = true
+	reply["match"] = match
+	return s.Node.Reply(msg, reply)
+}
+
+// Drops every slot from index onwards, handing their ids back to be ordered again
+func (s *Sequencer) truncate(index int) {
+	for _, slot := range s.Slots[index-1:] {
+		if slot.Origin == "" {
+			continue
+		}
+		id := EntryId{Origin: slot.Origin, Seq: slot.Seq}
+		delete(s.Ordered, id)
+		if _, exists := s.Payloads[id]; exists {
+			s.Unordered[id] = struct{}{}
+		}
+	}
+	s.Slots = s.Slots[:index-1]
+}
+
+// Returns the delivered log along with each entry's position in the total order
+func (s *Sequencer) OrderedRead(msg maelstrom.Message) error {
+	s.Mutex.Lock()
+	messages := make([]OrderedEntry, 0, len(s.Delivered))
+	for _, entry := range s.Delivered {
+		if entry.Origin != "" {
+			messages = append(messages, entry)
+		}
+	}
+	s.Mutex.Unlock()
+	return s.Node.Reply(msg, map[string]any{
+		"type":     "ordered_read_ok",
+		"messages": messages,
+	})
+}
@@ -0,0 +1,16 @@
+package main
+
+// Entry is a single broadcast message, identified by the node it originated from and
+// that node's sequence number for it
+type Entry struct {
+	Origin  string         `json:"origin"`
+	Seq     int            `json:"seq"`
+	Message any            `json:"message"`
+	Ttl     int            `json:"ttl"`             // Hops left before the entry stops being forwarded
+	Hops    int            `json:"hops"`            // Hops the entry has taken from its origin
+	Clock   map[string]int `json:"clock,omitempty"` // Causal dependencies, only set in causal mode
+	Topic   string         `json:"topic,omitempty"` // Set on pub/sub publications, which bypass the broadcast log
+	// Set in latency routing mode: the subtree of the origin's forwarding tree below the receiving node
+	Route map[string][]string `json:"route,omitempty"`
+	Round int                 `json:"round,omitempty"` // Gossip round the entry was broadcast in, only set in gossip routing mode
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Asks peers, one at a time, to transfer rights until this node holds at least need of them or
+// every peer has been asked. Peers that don't answer within BorrowTimeout are skipped, so during a
+// partition the decrement is rejected rather than left waiting.
+func (c *Counter) borrow(need int) {
+	for _, peer := range c.Node.NodeIDs() {
+		short := need - c.Ops.Rights(c.Id)
+		if short <= 0 {
+			return
+		}
+		if peer == c.Id {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.Config.BorrowTimeout)
+		reply, err := c.Node.SyncRPC(ctx, peer, map[string]any{
+			"type":   "borrow",
+			"amount": short,
+		})
+		cancel()
+		var body struct {
+			Ops []Op `json:"ops"`
+		}
+		if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+			continue
+		}
+		c.apply(body.Ops)
+	}
+}
+
+// Transfers as many of the requested rights as this node holds. The reply carries every op still
+// pending for the requester, transfer included, so it can spend them without waiting for a sync.
+func (c *Counter) Borrow(msg maelstrom.Message) error {
+	if c.Config.Mode != BoundedMode {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "borrow needs the bounded mode")
+	}
+	var body struct {
+		Amount int `json:"amount"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	c.KvMutex.Lock()
+	previous := c.Ops.Row(c.Id)
+	transferred, row := c.Ops.Transfer(c.Id, c.Node.NodeIDs(), msg.Src, body.Amount)
+	err := c.persist(previous, row)
+	c.KvMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Node.Reply(msg, map[string]any{
+		"type":        "borrow_ok",
+		"transferred": transferred,
+		"ops":         c.Ops.pendingFor(msg.Src),
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+
+	"github.com/notzree/gossip-glomers/env"
+)
+
+const (
+	OpMode = "ops" // Default: an unbounded counter
+	// Keeps the counter from going below zero by letting each node only spend the rights it holds
+	BoundedMode = "bounded"
+)
+
+// Config tunes op replication. Everything is read from the environment (see test.sh).
+type Config struct {
+	Mode          string
+	RetryInterval time.Duration // How often unacknowledged ops are sent again
+	// How many add request IDs are remembered, and for how long, to recognise retries
+	RequestLimit int
+	RequestTtl   time.Duration
+	// How long a node short of rights waits for each peer it asks to transfer some
+	BorrowTimeout time.Duration
+}
+
+func LoadConfig() Config {
+	return Config{
+		Mode:          env.String("COUNTER_MODE", OpMode),
+		RetryInterval: time.Duration(env.Int("COUNTER_RETRY_INTERVAL_MS", 200)) * time.Millisecond,
+		RequestLimit:  env.Int("COUNTER_REQUEST_LIMIT", 10000),
+		RequestTtl:    time.Duration(env.Int("COUNTER_REQUEST_TTL_MS", 60000)) * time.Millisecond,
+		BorrowTimeout: time.Duration(env.Int("COUNTER_BORROW_TIMEOUT_MS", 500)) * time.Millisecond,
+	}
+}
@@ -4,23 +4,35 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/requests"
 )
 
 type Counter struct {
-	Node    *maelstrom.Node
-	KvMutex *sync.Mutex
-	Kv      *maelstrom.KV
-	Id      string
+	Node      *maelstrom.Node
+	Config    Config
+	KvMutex   *sync.Mutex
+	Kv        *maelstrom.KV
+	Id        string
+	Ops       *OpLog
+	Requests  *requests.Set
+	Recovered *atomic.Bool // Set on a first start, or after a restart once Recover has heard from every peer
 }
 
-func NewCounter(n *maelstrom.Node) Counter {
+func NewCounter(n *maelstrom.Node, config Config) Counter {
 	return Counter{
-		Node:    n,
-		KvMutex: &sync.Mutex{},
-		Kv:      maelstrom.NewSeqKV(n),
+		Node:      n,
+		Config:    config,
+		KvMutex:   &sync.Mutex{},
+		Kv:        maelstrom.NewSeqKV(n),
+		Ops:       NewOpLog(),
+		Requests:  requests.New(config.RequestLimit, config.RequestTtl),
+		Recovered: &atomic.Bool{},
 	}
 }
 
@@ -31,150 +43,182 @@ func (c *Counter) Init(msg maelstrom.Message) error {
 	}
 	id := c.Node.ID()
 	c.Id = id
-	neighbors := c.Node.NodeIDs()
-	for _, node := range neighbors {
-		c.KvMutex.Lock()
-		writeCtx, writeCancel := context.WithCancel(context.Background())
-		defer writeCancel()
-		c.KvMutex.Unlock()
-		if err := c.Kv.Write(writeCtx, node, 0); err != nil {
-			log.Printf("Error initializing node %s: %v", node, err)
-			return err
-		}
+	c.KvMutex.Lock()
+	defer c.KvMutex.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Only creates our key, so a node that restarts or starts late never wipes a count
+	err := c.Kv.CompareAndSwap(ctx, id, Row{}, Row{}, true)
+	if err == nil {
+		// A first start, which has applied nothing it could be missing
+		c.Recovered.Store(true)
+		return nil
+	}
+	if maelstrom.ErrorCode(err) == maelstrom.PreconditionFailed {
+		err = c.resume(ctx)
+	}
+	if err != nil {
+		log.Printf("Error initializing node %s: %v", id, err)
+		return err
+	}
+	go c.Recover()
+	return nil
+}
+
+// Our key already holds a row, so this node restarted. Reads the row back and carries on from it.
+// seq-kv may answer a read from any state no older than our own last write, so a nonce is written
+// first to make sure the read sees the row's latest version. Must hold KvMutex.
+func (c *Counter) resume(ctx context.Context) error {
+	if err := c.Kv.Write(ctx, "nonce-"+c.Id, time.Now().UnixNano()); err != nil {
+		return err
+	}
+	value, err := c.Kv.Read(ctx, c.Id)
+	if err != nil {
+		return err
 	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var row Row
+	if err := json.Unmarshal(encoded, &row); err != nil {
+		return err
+	}
+	log.Printf("Resuming from op %d with count %d", row.Seq, row.Count)
+	c.Ops.Resume(c.Id, c.Node.NodeIDs(), row)
+	return nil
+}
+
+// Writes our row to our key, and once it is stored releases the ops it covers to peers. If the
+// write fails, those ops are rolled back to previous, so a retry of the add applies it afresh.
+// Must hold KvMutex.
+func (c *Counter) persist(previous Row, row Row) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := c.Kv.Write(ctx, c.Id, row); err != nil {
+		c.Ops.Rollback(c.Id, previous)
+		return err
+	}
+	c.Ops.Persisted(row.Seq)
 	return nil
 }
 
-// Increments local counter
+// Records the add in our own key, then replicates it to the other nodes in the background
 func (c *Counter) Add(msg maelstrom.Message) error {
 	var body map[string]any
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	// go func() {
-	// c.Node.Reply(msg, map[string]any{
-	// 	"type": "add_ok",
-	// })
-	// }()
+	// A retry, possibly of an add made on another node whose op already reached us
+	requestId, _ := body["request_id"].(string)
+	if !c.Requests.Claim(requestId) {
+		return c.Node.Reply(msg, map[string]any{
+			"type": "add_ok",
+		})
+	}
 	delta := int(body["delta"].(float64))
-	readCtx, readCancel := context.WithCancel(context.Background())
-	defer readCancel()
+	if c.Config.Mode == BoundedMode && delta < 0 {
+		c.borrow(-delta)
+	}
 	c.KvMutex.Lock()
-	value, err := c.Kv.ReadInt(readCtx, c.Id)
-	if err != nil {
-		log.Printf("Error reading node: %v", err)
-		return err
+	defer c.KvMutex.Unlock()
+	previous := c.Ops.Row(c.Id)
+	var row Row
+	if c.Config.Mode == BoundedMode {
+		applied := false
+		if row, applied = c.Ops.Spend(c.Id, c.Node.NodeIDs(), delta, requestId); !applied {
+			c.Requests.Forget(requestId)
+			return maelstrom.NewRPCError(maelstrom.PreconditionFailed, "not enough rights to decrement by "+strconv.Itoa(-delta))
+		}
+	} else {
+		row = c.Ops.Local(c.Id, c.Node.NodeIDs(), delta, requestId)
 	}
-	writeCtx, writeCancel := context.WithCancel(context.Background())
-	defer writeCancel()
-	if err := c.Kv.Write(writeCtx, c.Id, value+delta); err != nil {
+	if err := c.persist(previous, row); err != nil {
 		log.Printf("Error writing to node: %v", err)
+		c.Requests.Forget(requestId)
 		return err
 	}
-	c.KvMutex.Unlock()
-	//propogate write to neighbors
-	neighbors := c.Node.NodeIDs()
-	wg := &sync.WaitGroup{}
-	wg.Add(len(neighbors))
-
-	for _, node := range neighbors {
-		if node == c.Id {
-			continue
-		}
-		go func() {
-			c.Node.RPC(node, map[string]any{
-				"type":  "sync",
-				"delta": delta,
-			}, func(m maelstrom.Message) error {
-				defer wg.Done()
-				var body map[string]any
-				if err := json.Unmarshal(m.Body, &body); err != nil {
-					return err
-				}
-				return nil
-			})
-		}()
-	}
-	wg.Wait()
+	c.Requests.Done(requestId)
 	return c.Node.Reply(msg, map[string]any{
 		"type": "add_ok",
 	})
 }
 
+// Sums every op applied locally. A restarted node may be missing ops it had applied before until
+// Recover has heard from every peer, so it refuses reads until then.
 func (c *Counter) Read(msg maelstrom.Message) error {
 	var body map[string]any
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	neighbors := c.Node.NodeIDs()
-	// wg := &sync.WaitGroup{}
-	// wg.Add(len(neighbors))
-
-	sum := 0
-
-	for _, node := range neighbors {
-
-		readCtx, readCancel := context.WithCancel(context.Background())
-		c.KvMutex.Lock()
-		value, err := c.Kv.ReadInt(readCtx, node)
-		c.KvMutex.Unlock()
-		readCancel()
-		if err != nil {
-			log.Printf("Error reading node %s : %v", node, err)
-		}
-		sum += value
+	if !c.Recovered.Load() {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "still recovering ops from peers")
 	}
-
-	// for _, node := range neighbors {
-	// 	go func(n string, wg *sync.WaitGroup) {
-	// 		defer wg.Done()
-	// 		readCtx, readCancel := context.WithCancel(context.Background())
-	// 		c.KvMutex.Lock()
-	// 		value, err := c.Kv.ReadInt(readCtx, n)
-	// 		log.Default().Printf("Reading node %s with value %d", n, value)
-	// 		c.KvMutex.Unlock()
-	// 		readCancel()
-	// 		if err != nil {
-	// 			log.Printf("Error reading node %s : %v", n, err)
-	// 		}
-	// 		sumMutex.Lock()
-	// 		log.Default().Printf("Adding %d to sum", sum)
-	// 		sum += value
-	// 		sumMutex.Unlock()
-	// 	}(node, wg)
-	// }
-	// wg.Wait()
-	log.Default().Printf("Returning sum %d", sum)
 	return c.Node.Reply(msg, map[string]any{
 		"type":  "read_ok",
-		"value": sum,
+		"value": c.Ops.Value(),
 	})
 }
 
-// Updates local state with an incoming operation
+// Applies a batch of ops from the sender and acknowledges everything applied from it so far
 func (c *Counter) Sync(msg maelstrom.Message) error {
-	var body map[string]any
+	var body struct {
+		Ops []Op `json:"ops"`
+	}
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	incomingId := msg.Src
-	incomingDelta := int(body["delta"].(float64))
-	c.KvMutex.Lock()
-	readCtx, readCancel := context.WithCancel(context.Background())
-	defer readCancel()
-	value, err := c.Kv.ReadInt(readCtx, incomingId)
-	if err != nil {
-		return err
+	c.apply(body.Ops)
+	return c.Node.Reply(msg, map[string]any{
+		"type":    "sync_ok",
+		"applied": c.Ops.Seq(msg.Src),
+	})
+}
+
+// Applies ops from a peer, remembering the request IDs of the adds among them
+func (c *Counter) apply(ops []Op) {
+	for _, op := range c.Ops.Apply(ops) {
+		c.Requests.Done(op.RequestId)
 	}
-	writeCtx, writeCancel := context.WithCancel(context.Background())
-	err = c.Kv.Write(writeCtx, incomingId, value+incomingDelta)
-	writeCancel()
-	c.KvMutex.Unlock()
-	if err != nil {
-		log.Printf("Error syncing node: %v", err)
-		return err
+}
+
+// Asks every peer for the rows it has applied until each one answered, and takes the ones that are
+// ahead of ours. After a restart this brings back everything this node had applied from others,
+// including ops their origins dropped once we acknowledged them. Each origin answers with its own
+// latest row, so no origin is left behind the ops it still has pending for us.
+func (c *Counter) Recover() {
+	remaining := make([]string, 0, len(c.Node.NodeIDs()))
+	for _, node := range c.Node.NodeIDs() {
+		if node != c.Id {
+			remaining = append(remaining, node)
+		}
+	}
+	for len(remaining) > 0 {
+		unanswered := remaining[:0]
+		for _, peer := range remaining {
+			ctx, cancel := context.WithTimeout(context.Background(), c.Config.RetryInterval)
+			reply, err := c.Node.SyncRPC(ctx, peer, map[string]any{"type": "rows"})
+			cancel()
+			var body struct {
+				Rows map[string]Row `json:"rows"`
+			}
+			if err != nil || json.Unmarshal(reply.Body, &body) != nil {
+				unanswered = append(unanswered, peer)
+				continue
+			}
+			c.Ops.Restore(c.Id, body.Rows)
+		}
+		remaining = unanswered
+		if len(remaining) > 0 {
+			time.Sleep(c.Config.RetryInterval)
+		}
 	}
+	c.Recovered.Store(true)
+}
+
+func (c *Counter) Rows(msg maelstrom.Message) error {
 	return c.Node.Reply(msg, map[string]any{
-		"type": "sync_ok",
+		"type": "rows_ok",
+		"rows": c.Ops.copy(),
 	})
 }
@@ -1,5 +1,13 @@
 module github.com/notzree/gossip-glomers/grow-only-counter/v2
 
-go 1.22
+go 1.22.6
 
-require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20240408130303-0186f398f965
+require (
+	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20240408130303-0186f398f965
+	github.com/notzree/gossip-glomers/env v0.0.0
+	github.com/notzree/gossip-glomers/requests v0.0.0
+)
+
+replace github.com/notzree/gossip-glomers/env => ../env
+
+replace github.com/notzree/gossip-glomers/requests => ../requests
@@ -8,11 +8,14 @@ import (
 
 func main() {
 	n := maelstrom.NewNode()
-	counter := NewCounter(n)
+	counter := NewCounter(n, LoadConfig())
+	go counter.Retransmit()
 	n.Handle("init", counter.Init)
 	n.Handle("add", counter.Add)
 	n.Handle("read", counter.Read)
 	n.Handle("sync", counter.Sync)
+	n.Handle("borrow", counter.Borrow)
+	n.Handle("rows", counter.Rows)
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
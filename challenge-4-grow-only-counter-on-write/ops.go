@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Most ops sent to a peer in one sync
+const maxSyncOps = 1024
+
+// Op is a single add, identified by the node it was made on and that node's sequence number for it
+type Op struct {
+	Origin string `json:"origin"`
+	Seq    int    `json:"seq"`
+	Delta  int    `json:"delta"`
+	// The client's ID for the add, if it sent one, so that every node recognises a retry of it
+	RequestId string `json:"request_id,omitempty"`
+	// Set on a transfer of Delta rights from Origin to To, which leaves the counter's value unchanged
+	To string `json:"to,omitempty"`
+	// Set by a node that restarted, which no longer has the ops it made before. Replaces the origin's
+	// row if it is ahead of it, which brings peers that missed some of those ops up to date.
+	Reset *Row `json:"reset,omitempty"`
+}
+
+// Row is what an origin's ops add up to, as of the op numbered Seq. Every node stores its own row
+// under its ID in seq-kv.
+type Row struct {
+	Seq   int            `json:"seq"`
+	Count int            `json:"count"`
+	Sent  map[string]int `json:"sent,omitempty"` // Rights transferred to each node in bounded mode
+}
+
+func (r *Row) copy() Row {
+	copied := *r
+	copied.Sent = make(map[string]int, len(r.Sent))
+	for node, amount := range r.Sent {
+		copied.Sent[node] = amount
+	}
+	return copied
+}
+
+// OpLog replicates adds as ops. Every op stays pending for a peer until that peer acknowledges it,
+// and peers apply each origin's ops exactly once, in sequence order.
+//
+// A node's rights in bounded mode are its own count plus what every node sent it minus what it sent.
+// As only the node itself ever spends or sends them, its view of its own rights can only lag
+// behind by transfers still on their way to it.
+type OpLog struct {
+	Mutex   *sync.Mutex
+	Pending map[string][]Op // Ops each peer has not acknowledged yet, in sequence order
+	Rows    map[string]*Row // Everything applied so far, per origin
+	// Highest of our own sequence numbers whose row is stored in seq-kv. Later ops are held back,
+	// so a restarted node never finds a peer that is ahead of the row it reads back.
+	Durable int
+}
+
+func NewOpLog() *OpLog {
+	return &OpLog{
+		Mutex:   &sync.Mutex{},
+		Pending: make(map[string][]Op),
+		Rows:    make(map[string]*Row),
+	}
+}
+
+// Applies a new local add and queues it for every peer. Returns this node's new row.
+func (o *OpLog) Local(self string, peers []string, delta int, requestId string) Row {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	o.local(self, peers, Op{Delta: delta, RequestId: requestId})
+	return o.row(self).copy()
+}
+
+// Like Local, but a decrement is only applied if this node holds enough rights to cover it.
+// Returns this node's new row and whether the add was applied.
+func (o *OpLog) Spend(self string, peers []string, delta int, requestId string) (Row, bool) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	if delta < 0 && o.rights(self) < -delta {
+		return o.row(self).copy(), false
+	}
+	o.local(self, peers, Op{Delta: delta, RequestId: requestId})
+	return o.row(self).copy(), true
+}
+
+// Transfers up to amount of this node's rights to another node and returns how many it
+// transferred, along with this node's new row
+func (o *OpLog) Transfer(self string, peers []string, to string, amount int) (int, Row) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	amount = min(amount, o.rights(self))
+	if amount <= 0 {
+		return 0, o.row(self).copy()
+	}
+	o.local(self, peers, Op{Delta: amount, To: to})
+	return amount, o.row(self).copy()
+}
+
+// Undoes our own ops after previous, for when the row covering them couldn't be stored. None of
+// them has reached a peer, as only stored ops are sent.
+func (o *OpLog) Rollback(self string, previous Row) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	restored := previous.copy()
+	o.Rows[self] = &restored
+	for peer, ops := range o.Pending {
+		for len(ops) > 0 && ops[len(ops)-1].Seq > previous.Seq {
+			ops = ops[:len(ops)-1]
+		}
+		o.Pending[peer] = ops
+	}
+}
+
+// Records that our row is stored in seq-kv up to seq, which releases our ops up to it to peers
+func (o *OpLog) Persisted(seq int) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	o.Durable = max(o.Durable, seq)
+}
+
+// Takes back our own row after a restart, and queues a reset to it for every peer
+func (o *OpLog) Resume(self string, peers []string, row Row) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	if row.Seq <= o.row(self).Seq {
+		return
+	}
+	o.Rows[self] = &row
+	o.Durable = row.Seq
+	reset := row.copy()
+	for _, peer := range peers {
+		if peer != self {
+			o.Pending[peer] = append(o.Pending[peer], Op{Origin: self, Seq: row.Seq, Reset: &reset})
+		}
+	}
+}
+
+// Takes every row of another origin that is ahead of ours. Our own row is left alone, as the one in
+// seq-kv is never behind a peer's.
+func (o *OpLog) Restore(self string, rows map[string]Row) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	for origin, row := range rows {
+		if origin != self && row.Seq > o.row(origin).Seq {
+			restored := row.copy()
+			o.Rows[origin] = &restored
+		}
+	}
+}
+
+func (o *OpLog) Rights(node string) int {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	return o.rights(node)
+}
+
+// Must hold Mutex
+func (o *OpLog) rights(node string) int {
+	rights := o.row(node).Count
+	for origin, row := range o.Rows {
+		rights += row.Sent[node]
+		if origin == node {
+			for _, amount := range row.Sent {
+				rights -= amount
+			}
+		}
+	}
+	return rights
+}
+
+// Returns origin's row, creating an empty one if needed. Must hold Mutex.
+func (o *OpLog) row(origin string) *Row {
+	if o.Rows[origin] == nil {
+		o.Rows[origin] = &Row{Sent: make(map[string]int)}
+	}
+	return o.Rows[origin]
+}
+
+// Numbers a new op of ours, applies it and queues it for every peer. Must hold Mutex.
+func (o *OpLog) local(self string, peers []string, op Op) {
+	op.Origin = self
+	op.Seq = o.row(self).Seq + 1
+	o.apply(op)
+	for _, peer := range peers {
+		if peer != self {
+			o.Pending[peer] = append(o.Pending[peer], op)
+		}
+	}
+}
+
+// Must hold Mutex
+func (o *OpLog) apply(op Op) {
+	row := o.row(op.Origin)
+	row.Seq = op.Seq
+	if op.To == "" {
+		row.Count += op.Delta
+		return
+	}
+	row.Sent[op.To] += op.Delta
+}
+
+// Applies every op that is next in its origin's sequence and skips the ones already applied.
+// An op after a gap is left for the sender to retransmit, which it does from its oldest pending op.
+// Returns the ops that were applied.
+func (o *OpLog) Apply(ops []Op) []Op {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	applied := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Reset != nil {
+			if op.Reset.Seq > o.row(op.Origin).Seq {
+				reset := op.Reset.copy()
+				o.Rows[op.Origin] = &reset
+				applied = append(applied, op)
+			}
+			continue
+		}
+		if op.Seq != o.row(op.Origin).Seq+1 {
+			continue
+		}
+		o.apply(op)
+		applied = append(applied, op)
+	}
+	return applied
+}
+
+// Drops the ops peer has acknowledged, which are every one of ours up to seq
+func (o *OpLog) Ack(peer string, seq int) {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	pending := o.Pending[peer]
+	for len(pending) > 0 && pending[0].Seq <= seq {
+		pending = pending[1:]
+	}
+	o.Pending[peer] = pending
+}
+
+// Returns a copy of origin's row
+func (o *OpLog) Row(origin string) Row {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	return o.row(origin).copy()
+}
+
+// Returns the highest sequence number applied from origin
+func (o *OpLog) Seq(origin string) int {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	return o.row(origin).Seq
+}
+
+func (o *OpLog) Value() int {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	value := 0
+	for _, row := range o.Rows {
+		value += row.Count
+	}
+	return value
+}
+
+func (o *OpLog) copy() map[string]Row {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	rows := make(map[string]Row, len(o.Rows))
+	for origin, row := range o.Rows {
+		rows[origin] = row.copy()
+	}
+	return rows
+}
+
+// Returns the oldest pending ops for each peer, at most maxSyncOps of them
+func (o *OpLog) pending() map[string][]Op {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	pending := make(map[string][]Op, len(o.Pending))
+	for peer := range o.Pending {
+		if ops := o.durable(peer); len(ops) > 0 {
+			pending[peer] = ops
+		}
+	}
+	return pending
+}
+
+func (o *OpLog) pendingFor(peer string) []Op {
+	o.Mutex.Lock()
+	defer o.Mutex.Unlock()
+	return o.durable(peer)
+}
+
+// Returns a copy of the oldest ops pending for peer that are already stored, at most maxSyncOps of
+// them. Must hold Mutex.
+func (o *OpLog) durable(peer string) []Op {
+	ops := o.Pending[peer]
+	end := 0
+	for end < len(ops) && end < maxSyncOps && ops[end].Seq <= o.Durable {
+		end++
+	}
+	return append([]Op(nil), ops[:end]...)
+}
+
+// Periodically sends every peer the ops it has not acknowledged, until it does
+func (c *Counter) Retransmit() error {
+	for {
+		time.Sleep(c.Config.RetryInterval)
+		for peer, ops := range c.Ops.pending() {
+			_ = c.Node.RPC(peer, map[string]any{
+				"type": "sync",
+				"ops":  ops,
+			}, func(reply maelstrom.Message) error {
+				var body struct {
+					Applied int `json:"applied"`
+				}
+				if err := json.Unmarshal(reply.Body, &body); err != nil || reply.RPCError() != nil {
+					return nil
+				}
+				c.Ops.Ack(peer, body.Applied)
+				return nil
+			})
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+const receiver = "r"
+
+// Makes ops adds on each of nodes origins, all stored and pending for receiver. Returns the
+// origins' logs and what the adds sum to.
+func opOrigins(rng *rand.Rand, nodes int, ops int) ([]*OpLog, int) {
+	origins := make([]*OpLog, nodes)
+	for i := range origins {
+		origins[i] = NewOpLog()
+	}
+	total := 0
+	for range ops {
+		i := rng.IntN(nodes)
+		delta := rng.IntN(10) - 3
+		row := origins[i].Local(fmt.Sprintf("n%d", i), []string{receiver}, delta, "")
+		origins[i].Persisted(row.Seq)
+		total += delta
+	}
+	return origins, total
+}
+
+// Returns the ops shuffled, with about a quarter of them sent twice and about a quarter dropped
+func mangled(rng *rand.Rand, ops []Op) []Op {
+	sent := make([]Op, 0, len(ops))
+	for _, op := range ops {
+		switch rng.IntN(4) {
+		case 0:
+			sent = append(sent, op, op)
+		case 1:
+		default:
+			sent = append(sent, op)
+		}
+	}
+	rng.Shuffle(len(sent), func(i, j int) { sent[i], sent[j] = sent[j], sent[i] })
+	return sent
+}
+
+// Feeds ops to log and fails unless every applied op is the next one of its origin
+func applyChecked(t *testing.T, log *OpLog, ops []Op) {
+	t.Helper()
+	for _, op := range ops {
+		before := log.Seq(op.Origin)
+		applied := log.Apply([]Op{op})
+		if after := log.Seq(op.Origin); after != before && after != before+1 {
+			t.Fatalf("%s went from %d to %d applying op %d", op.Origin, before, after, op.Seq)
+		}
+		if len(applied) == 1 && op.Seq != before+1 {
+			t.Fatalf("applied %s/%d after %d of its origin's ops", op.Origin, op.Seq, before)
+		}
+		if len(applied) == 0 && op.Seq == before+1 {
+			t.Fatalf("skipped %s/%d, which was next", op.Origin, op.Seq)
+		}
+	}
+}
+
+// Retransmits every origin's pending ops duplicated, reordered and with gaps until the receiver has
+// acked them all. Acks get lost or arrive stale too, which only delays them.
+func TestApplyUnderDuplicationAndReordering(t *testing.T) {
+	for seed := range uint64(200) {
+		rng := rand.New(rand.NewPCG(seed, 0))
+		origins, total := opOrigins(rng, 3, 200)
+		log := NewOpLog()
+		for round := 0; ; round++ {
+			if round == 1000 {
+				t.Fatalf("seed %d: ops still pending after %d rounds", seed, round)
+			}
+			sync := make([]Op, 0)
+			for _, origin := range origins {
+				sync = append(sync, origin.pendingFor(receiver)...)
+			}
+			if len(sync) == 0 {
+				break
+			}
+			applyChecked(t, log, mangled(rng, sync))
+			for i, origin := range origins {
+				applied := log.Seq(fmt.Sprintf("n%d", i))
+				switch rng.IntN(4) {
+				case 0:
+				case 1:
+					origin.Ack(receiver, rng.IntN(applied+1))
+				default:
+					origin.Ack(receiver, applied)
+				}
+			}
+		}
+		if value := log.Value(); value != total {
+			t.Fatalf("seed %d: value is %d, want %d", seed, value, total)
+		}
+	}
+}
+
+func TestApplyLeavesGaps(t *testing.T) {
+	log := NewOpLog()
+	if applied := log.Apply([]Op{{Origin: "n0", Seq: 2, Delta: 5}, {Origin: "n0", Seq: 3, Delta: 5}}); len(applied) != 0 {
+		t.Fatalf("applied %v after a gap", applied)
+	}
+	applied := log.Apply([]Op{{Origin: "n0", Seq: 1, Delta: 1}, {Origin: "n0", Seq: 3, Delta: 5}, {Origin: "n0", Seq: 2, Delta: 2}})
+	if len(applied) != 2 || log.Seq("n0") != 2 || log.Value() != 3 {
+		t.Fatalf("applied %v up to %d with value %d, want ops 1 and 2 with value 3", applied, log.Seq("n0"), log.Value())
+	}
+	if applied := log.Apply([]Op{{Origin: "n0", Seq: 1, Delta: 1}, {Origin: "n0", Seq: 2, Delta: 2}}); len(applied) != 0 {
+		t.Fatalf("applied %v again", applied)
+	}
+}
+
+// Acks only ever drop the pending ops they cover, however stale or repeated they are
+func TestAckStaleAndRepeated(t *testing.T) {
+	log := NewOpLog()
+	for range 5 {
+		log.Persisted(log.Local("n0", []string{receiver}, 1, "").Seq)
+	}
+	for _, step := range []struct{ ack, next int }{
+		{3, 4}, // First ack
+		{3, 4}, // Repeated
+		{1, 4}, // Stale
+		{0, 4}, // From a receiver that restarted empty
+		{5, 0}, // Everything
+		{2, 0}, // Stale once nothing is pending
+		{9, 0}, // Ahead of anything we sent
+	} {
+		log.Ack(receiver, step.ack)
+		pending := log.pendingFor(receiver)
+		next := 0
+		if len(pending) > 0 {
+			next = pending[0].Seq
+		}
+		if next != step.next {
+			t.Fatalf("after ack %d the oldest pending op is %d, want %d", step.ack, next, step.next)
+		}
+	}
+	if seq := log.Seq("n0"); seq != 5 {
+		t.Fatalf("acks moved our own row to %d", seq)
+	}
+}
+
+// A rolled back op is gone from our row and from every peer's queue, and its number is reused
+func TestRollback(t *testing.T) {
+	log := NewOpLog()
+	peers := []string{"n0", receiver, "n2"}
+	log.Persisted(log.Local("n0", peers, 2, "").Seq)
+	previous := log.Row("n0")
+	log.Local("n0", peers, 5, "")
+	log.Transfer("n0", peers, "n2", 1)
+	log.Rollback("n0", previous)
+	if row := log.Row("n0"); row.Seq != 1 || row.Count != 2 || row.Sent["n2"] != 0 {
+		t.Fatalf("rolled back to %+v, want op 1 with count 2", row)
+	}
+	for _, peer := range []string{receiver, "n2"} {
+		if pending := log.Pending[peer]; len(pending) != 1 || pending[0].Seq != 1 {
+			t.Fatalf("%s still has %v pending", peer, pending)
+		}
+	}
+	if row := log.Local("n0", peers, 3, ""); row.Seq != 2 || row.Count != 5 {
+		t.Fatalf("next op made %+v, want op 2 with count 5", row)
+	}
+}
@@ -1,9 +1,11 @@
 #!/bin/bash
+# Runs the g-counter workload under partitions, then the pn-counter workload in bounded mode
 
 maelstrom_path="../maelstrom"  
 cwd=$(pwd)
 
 go build -o bin
 cd "$maelstrom_path" || exit
-./maelstrom test -w g-counter --bin $cwd/bin --node-count 3 --rate 100 --time-limit 20 
+./maelstrom test -w g-counter --bin $cwd/bin --node-count 3 --rate 100 --time-limit 20 --nemesis partition
+COUNTER_MODE=bounded ./maelstrom test -w pn-counter --bin $cwd/bin --node-count 3 --rate 100 --time-limit 20 --nemesis partition
 cd "$cwd" || exit
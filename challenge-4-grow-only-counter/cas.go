@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math/rand/v2"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// The single key every node adds to in cas mode
+const casKey = "counter"
+
+// Creates the key unless another node already has. Either way there is nothing more to do.
+func (c *Counter) CasInit(msg maelstrom.Message) error {
+	c.Id = c.Node.ID()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": casKey, "from": 0, "to": 0})
+	err := c.Kv.CompareAndSwap(ctx, casKey, 0, 0, true)
+	if err != nil && maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+		log.Printf("Error initializing %s: %v", casKey, err)
+		return err
+	}
+	return nil
+}
+
+// Adds delta to the shared key with compare-and-swap, retrying with backoff until no other add
+// got in between. A stale read only makes the swap fail, so it costs a retry rather than an add.
+func (c *Counter) CasAdd(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if counterName(body) != defaultCounter {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "named counters need the sync-on-read, state or delta mode")
+	}
+	requestId, _ := body["request_id"].(string)
+	if !c.Requests.Claim(requestId) {
+		return c.Node.Reply(msg, map[string]any{
+			"type": "add_ok",
+		})
+	}
+	delta := int(body["delta"].(float64))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for attempt := 0; ; attempt++ {
+		value, err := c.readShared(ctx)
+		if err != nil {
+			log.Printf("Error reading %s: %v", casKey, err)
+			c.Requests.Forget(requestId)
+			return err
+		}
+		c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": casKey, "from": value, "to": value + delta})
+		err = c.Kv.CompareAndSwap(ctx, casKey, value, value+delta, true)
+		if err == nil {
+			break
+		}
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			log.Printf("Error swapping %s: %v", casKey, err)
+			c.Requests.Forget(requestId)
+			return err
+		}
+		time.Sleep(c.backoff(attempt))
+	}
+	c.Requests.Done(requestId)
+	return c.Node.Reply(msg, map[string]any{
+		"type": "add_ok",
+	})
+}
+
+// seq-kv may answer a read from any earlier state, but not one older than this node's own last
+// write. Writing a fresh nonce to this node's nonce key first makes the read that follows see
+// every add that completed before the nonce was written.
+func (c *Counter) CasRead(msg maelstrom.Message) error {
+	var body struct {
+		Counter string `json:"counter"`
+		At      *int64 `json:"at"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Counter != defaultCounter {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "named counters need the sync-on-read, state or delta mode")
+	}
+	if body.At != nil {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "history needs the state or delta mode")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key, nonce := "nonce-"+c.Id, c.Nonces.Add(1)
+	c.Metrics.Record("kv-write", map[string]any{"type": "write", "key": key, "value": nonce})
+	if err := c.Kv.Write(ctx, key, nonce); err != nil {
+		log.Printf("Error writing %s: %v", key, err)
+		return err
+	}
+	value, err := c.readShared(ctx)
+	if err != nil {
+		log.Printf("Error reading %s: %v", casKey, err)
+		return err
+	}
+	return c.Node.Reply(msg, map[string]any{
+		"type":  "read_ok",
+		"value": value,
+	})
+}
+
+// Reads the shared key, which counts as 0 until the first add or init creates it
+func (c *Counter) readShared(ctx context.Context) (int, error) {
+	c.Metrics.Record("kv-read", map[string]any{"type": "read", "key": casKey})
+	value, err := c.Kv.ReadInt(ctx, casKey)
+	if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+		return 0, nil
+	}
+	return value, err
+}
+
+// Full jitter: a random wait of up to CasBackoff doubled once per failed attempt, capped at CasMaxBackoff
+func (c *Counter) backoff(attempt int) time.Duration {
+	ceiling := min(c.Config.CasBackoff<<min(attempt, 16), c.Config.CasMaxBackoff)
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
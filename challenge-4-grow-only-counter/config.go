@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/notzree/gossip-glomers/env"
+)
+
+const (
+	SyncOnRead = "sync-on-read" // Each node keeps its own count in seq-kv, and read asks every node for theirs
+	StateMode  = "state"        // State based G-Counter CRDT, gossiped to every node and read locally
+	DeltaMode  = "delta"        // Like StateMode, but only ships the deltas each node hasn't acknowledged
+	CasMode    = "cas"          // One global key in seq-kv, updated with compare-and-swap
+)
+
+// Read consistency levels in sync-on-read mode: how many nodes, this one included, have to answer
+const (
+	LocalRead  = "local"  // Only this node, everything else comes from earlier reads
+	QuorumRead = "quorum" // A majority
+	AllRead    = "all"    // Every node
+)
+
+// Config selects and tunes the counter mode. Everything is read from the environment (see test.sh).
+type Config struct {
+	Mode           string
+	GossipInterval time.Duration // How often state or deltas are sent to every other node
+	// Consistency level for reads that don't ask for one, and how long they wait for other nodes
+	ReadConsistency string
+	ReadTimeout     time.Duration
+	// How many add request IDs are remembered, and for how long, to recognise retries
+	RequestLimit int
+	RequestTtl   time.Duration
+	// Bounds of the jittered exponential backoff between failed compare-and-swaps in cas mode
+	CasBackoff    time.Duration
+	CasMaxBackoff time.Duration
+	// Resolution and reach of the history kept in state and delta modes. Adds are bucketed by
+	// HistoryBucket, by HistoryCoarseBucket once older than HistoryDownsampleAfter, and only their
+	// total is kept once older than HistoryRetention.
+	HistoryBucket          time.Duration
+	HistoryCoarseBucket    time.Duration
+	HistoryDownsampleAfter time.Duration
+	HistoryRetention       time.Duration
+}
+
+func LoadConfig() Config {
+	return Config{
+		Mode:                   env.String("COUNTER_MODE", SyncOnRead),
+		GossipInterval:         time.Duration(env.Int("COUNTER_GOSSIP_INTERVAL_MS", 500)) * time.Millisecond,
+		ReadConsistency:        env.String("COUNTER_READ_CONSISTENCY", AllRead),
+		ReadTimeout:            time.Duration(env.Int("COUNTER_READ_TIMEOUT_MS", 1000)) * time.Millisecond,
+		RequestLimit:           env.Int("COUNTER_REQUEST_LIMIT", 10000),
+		RequestTtl:             time.Duration(env.Int("COUNTER_REQUEST_TTL_MS", 60000)) * time.Millisecond,
+		CasBackoff:             time.Duration(env.Int("COUNTER_CAS_BACKOFF_MS", 5)) * time.Millisecond,
+		CasMaxBackoff:          time.Duration(env.Int("COUNTER_CAS_MAX_BACKOFF_MS", 200)) * time.Millisecond,
+		HistoryBucket:          time.Duration(env.Int("COUNTER_HISTORY_BUCKET_MS", 1000)) * time.Millisecond,
+		HistoryCoarseBucket:    time.Duration(env.Int("COUNTER_HISTORY_COARSE_BUCKET_MS", 60000)) * time.Millisecond,
+		HistoryDownsampleAfter: time.Duration(env.Int("COUNTER_HISTORY_DOWNSAMPLE_AFTER_MS", 60000)) * time.Millisecond,
+		HistoryRetention:       time.Duration(env.Int("COUNTER_HISTORY_RETENTION_MS", 3600000)) * time.Millisecond,
+	}
+}
@@ -3,24 +3,48 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"log"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/requests"
 )
 
 type Counter struct {
 	Node    *maelstrom.Node
+	Config  Config
 	KvMutex *sync.Mutex
 	Kv      *maelstrom.KV
 	Id      string
+	// Freshest count seen from every node by counter name, read or not, in sync-on-read mode
+	KnownMutex *sync.Mutex
+	Known      map[string]map[string]int
+	Names      map[string]struct{} // Named counters this node has registered in seq-kv, in sync-on-read mode
+	Requests   *requests.Set
+	State      *Replica     // Only used in state and delta modes
+	Deltas     *DeltaBuffer // Only used in delta mode
+	Metrics    *Metrics
+	Nonces     *atomic.Int64 // Last nonce written before a read in cas mode
 }
 
-func NewCounter(n *maelstrom.Node) Counter {
+func NewCounter(n *maelstrom.Node, config Config) Counter {
 	return Counter{
-		Node:    n,
-		KvMutex: &sync.Mutex{},
-		Kv:      maelstrom.NewSeqKV(n),
+		Node:       n,
+		Config:     config,
+		KvMutex:    &sync.Mutex{},
+		Kv:         maelstrom.NewSeqKV(n),
+		KnownMutex: &sync.Mutex{},
+		Known:      make(map[string]map[string]int),
+		Names:      make(map[string]struct{}),
+		Requests:   requests.New(config.RequestLimit, config.RequestTtl),
+		State:      NewReplica(config),
+		Deltas:     NewDeltaBuffer(),
+		Metrics:    NewMetrics(),
+		Nonces:     &atomic.Int64{},
 	}
 }
 
@@ -33,95 +57,200 @@ func (c *Counter) Init(msg maelstrom.Message) error {
 	defer c.KvMutex.Unlock()
 	id := c.Node.ID()
 	c.Id = id
-	writeCtx, writeCancel := context.WithCancel(context.Background())
-	defer writeCancel()
-	if err := c.Kv.Write(writeCtx, id, 0); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Only creates our key, so a restarted node carries on from the count it had reached
+	c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": id, "from": 0, "to": 0})
+	err := c.Kv.CompareAndSwap(ctx, id, 0, 0, true)
+	if err != nil && maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
 		log.Printf("Error initializing node: %v", err)
 		return err
 	}
 	return nil
 }
 
-// Increments local counter
+// Increments our own key for the counter with compare-and-swap, and only acknowledges the add once
+// it is stored. After a restart a read of our key may be stale, which the swap catches.
 func (c *Counter) Add(msg maelstrom.Message) error {
 	var body map[string]any
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	go func() {
-		c.Node.Reply(msg, map[string]any{
+	counter := counterName(body)
+	delta := int(body["delta"].(float64))
+	// Reads keep the highest count they have seen from each node, so a count may never go down
+	if delta < 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "sync-on-read counters only take non-negative deltas")
+	}
+	requestId, _ := body["request_id"].(string)
+	if !c.Requests.Claim(requestId) {
+		return c.Node.Reply(msg, map[string]any{
 			"type": "add_ok",
 		})
-	}()
-	delta := int(body["delta"].(float64))
-	readCtx, readCancel := context.WithCancel(context.Background())
-	defer readCancel()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	c.KvMutex.Lock()
 	defer c.KvMutex.Unlock()
-	value, err := c.Kv.ReadInt(readCtx, c.Id)
-	if err != nil {
-		log.Printf("Error reading node: %v", err)
+	if err := c.register(ctx, counter); err != nil {
+		log.Printf("Error registering counter %q: %v", counter, err)
+		c.Requests.Forget(requestId)
 		return err
 	}
-	writeCtx, writeCancel := context.WithCancel(context.Background())
-	defer writeCancel()
-	if err := c.Kv.Write(writeCtx, c.Id, value+delta); err != nil {
-		log.Printf("Error writing to node: %v", err)
-		return err
+	key := c.key(counter)
+	for attempt := 0; ; attempt++ {
+		value, err := c.readOwn(ctx, key)
+		if err != nil {
+			log.Printf("Error reading node: %v", err)
+			c.Requests.Forget(requestId)
+			return err
+		}
+		// Named counters' keys are only created by their first add
+		c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": key, "from": value, "to": value + delta})
+		err = c.Kv.CompareAndSwap(ctx, key, value, value+delta, true)
+		if err == nil {
+			break
+		}
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			log.Printf("Error writing to node: %v", err)
+			c.Requests.Forget(requestId)
+			return err
+		}
+		time.Sleep(c.backoff(attempt))
 	}
-	return nil
+	c.Requests.Done(requestId)
+	return c.Node.Reply(msg, map[string]any{
+		"type": "add_ok",
+	})
 }
 
+// Sums every node's count. Other nodes are asked for theirs, and the read succeeds once as many of
+// them answered within the timeout as the consistency level needs. Nodes that didn't answer count
+// with the freshest value this node has seen from them, and the reply lists the ones that answered.
 func (c *Counter) Read(msg maelstrom.Message) error {
-	var body map[string]any
+	var body struct {
+		Counter     string `json:"counter"`
+		At          *int64 `json:"at"`
+		Consistency string `json:"consistency"`
+		TimeoutMs   int    `json:"timeout_ms"`
+	}
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
-	wg := &sync.WaitGroup{}
-	value := 0
+	if body.At != nil {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "history needs the state or delta mode")
+	}
+	consistency := body.Consistency
+	if consistency == "" {
+		consistency = c.Config.ReadConsistency
+	}
 	nodes := c.Node.NodeIDs()
+	var required int
+	switch consistency {
+	case LocalRead:
+		required = 1
+	case QuorumRead:
+		required = len(nodes)/2 + 1
+	case AllRead:
+		required = len(nodes)
+	default:
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "consistency must be local, quorum or all")
+	}
+	timeout := c.Config.ReadTimeout
+	if body.TimeoutMs > 0 {
+		timeout = time.Duration(body.TimeoutMs) * time.Millisecond
+	}
+
+	readCtx, readCancel := context.WithTimeout(context.Background(), timeout)
+	defer readCancel()
+	localValue, err := c.readOwn(readCtx, c.key(body.Counter))
+	if err != nil {
+		log.Printf("Error reading node: %v", err)
+		return err
+	}
+	c.remember(body.Counter, c.Id, localValue)
+	contributors := []string{c.Id}
+	if consistency != LocalRead {
+		contributors = append(contributors, c.syncAll(body.Counter, nodes, timeout)...)
+	}
+	if len(contributors) < required {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable,
+			fmt.Sprintf("%s read reached %d of the %d nodes it needs", consistency, len(contributors), required))
+	}
+	sort.Strings(contributors)
+
+	value := 0
+	c.KnownMutex.Lock()
+	for _, node := range nodes {
+		value += c.Known[body.Counter][node]
+	}
+	c.KnownMutex.Unlock()
+	return c.Node.Reply(msg, map[string]any{
+		"type":        "read_ok",
+		"value":       value,
+		"consistency": consistency,
+		"nodes":       contributors,
+	})
+}
+
+// Asks every other node for its count of counter and returns the ones that answered within timeout
+func (c *Counter) syncAll(counter string, nodes []string, timeout time.Duration) []string {
+	replies := make(chan string, len(nodes))
+	asked := 0
 	for _, node := range nodes {
 		if node == c.Id {
-			readCtx, readCancel := context.WithCancel(context.Background())
-			defer readCancel()
-			localValue, err := c.Kv.ReadInt(readCtx, c.Id)
-			if err != nil {
-				log.Printf("Error reading node: %v", err)
-				return err
-			}
-			value += localValue
 			continue
 		}
-		wg.Add(1)
-		_ = c.Node.RPC(node, map[string]any{
-			"type": "sync",
-		}, func(msg maelstrom.Message) error {
-			var body map[string]any
-			if err := json.Unmarshal(msg.Body, &body); err != nil {
-				return err
+		asked++
+		request := map[string]any{"type": "sync", "counter": counter}
+		c.Metrics.Record("sync", request)
+		_ = c.Node.RPC(node, request, func(msg maelstrom.Message) error {
+			var body struct {
+				Value int `json:"value"`
+			}
+			if err := json.Unmarshal(msg.Body, &body); err != nil || msg.RPCError() != nil {
+				return nil
 			}
-			value += int(body["value"].(float64))
-			wg.Done()
+			c.remember(counter, node, body.Value)
+			replies <- node
 			return nil
 		})
 	}
-	wg.Wait()
-	return c.Node.Reply(msg, map[string]any{
-		"type":  "read_ok",
-		"value": value,
-	})
+	answered := make([]string, 0, asked)
+	deadline := time.After(timeout)
+	for len(answered) < asked {
+		select {
+		case node := <-replies:
+			answered = append(answered, node)
+		case <-deadline:
+			return answered
+		}
+	}
+	return answered
+}
+
+// Counts only grow, so a value older than one already seen is ignored
+func (c *Counter) remember(counter string, node string, value int) {
+	c.KnownMutex.Lock()
+	defer c.KnownMutex.Unlock()
+	if c.Known[counter] == nil {
+		c.Known[counter] = make(map[string]int)
+	}
+	c.Known[counter][node] = max(c.Known[counter][node], value)
 }
 
-// Reads local counter and returns it to sync with the read node to return global counter
+// Reads our count of the named counter and returns it to the node that is reading it
 func (c *Counter) Sync(msg maelstrom.Message) error {
-	var body map[string]any
+	var body struct {
+		Counter string `json:"counter"`
+	}
 	if err := json.Unmarshal(msg.Body, &body); err != nil {
 		return err
 	}
 	c.KvMutex.Lock()
 	readCtx, readCancel := context.WithCancel(context.Background())
 	defer readCancel()
-	value, err := c.Kv.ReadInt(readCtx, c.Id)
+	value, err := c.readOwn(readCtx, c.key(body.Counter))
 	c.KvMutex.Unlock()
 	if err != nil {
 		log.Printf("Error syncing node: %v", err)
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Most deltas kept for peers that haven't acknowledged them. Peers that fall further behind get full state.
+const maxDeltas = 1024
+
+// DeltaBuffer holds the join-deltas this node has produced or received, numbered consecutively, and
+// the number of the first delta each peer has not acknowledged yet. Deltas every peer has acknowledged
+// are dropped, as are the oldest ones once there are too many.
+type DeltaBuffer struct {
+	Mutex  *sync.Mutex
+	Start  int            // Number of Deltas[0]
+	Deltas []Update       // Join-deltas of the counters, in the order they were produced or received
+	Acked  map[string]int // Every delta numbered below Acked[peer] has been acknowledged by peer
+}
+
+func NewDeltaBuffer() *DeltaBuffer {
+	return &DeltaBuffer{
+		Mutex: &sync.Mutex{},
+		Acked: make(map[string]int),
+	}
+}
+
+func (d *DeltaBuffer) Push(delta Update) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	d.Deltas = append(d.Deltas, delta)
+	if len(d.Deltas) > maxDeltas {
+		d.Deltas = d.Deltas[1:]
+		d.Start++
+	}
+}
+
+// Returns the join of every delta peer has not acknowledged, and the number to acknowledge it with.
+// ok is false if some of those deltas were already dropped, in which case peer needs full state.
+func (d *DeltaBuffer) For(peer string) (delta Update, end int, ok bool) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	end = d.Start + len(d.Deltas)
+	if d.Acked[peer] < d.Start {
+		return Update{}, end, false
+	}
+	delta = NewUpdate()
+	for _, interval := range d.Deltas[d.Acked[peer]-d.Start:] {
+		delta.Join(interval)
+	}
+	return delta, end, true
+}
+
+// Records that peer has every delta numbered below end, and drops the ones every peer has
+func (d *DeltaBuffer) Ack(peer string, end int, peers []string) {
+	d.Mutex.Lock()
+	defer d.Mutex.Unlock()
+	d.Acked[peer] = max(d.Acked[peer], end)
+	acked := d.Start + len(d.Deltas)
+	for _, node := range peers {
+		acked = min(acked, d.Acked[node])
+	}
+	if acked > d.Start {
+		d.Deltas = d.Deltas[acked-d.Start:]
+		d.Start = acked
+	}
+}
+
+func (c *Counter) DeltaAdd(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	delta, ok := body["delta"].(float64)
+	if !ok {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "delta must be a number")
+	}
+	requestId, _ := body["request_id"].(string)
+	if !c.Requests.Claim(requestId) {
+		return c.Node.Reply(msg, map[string]any{
+			"type": "add_ok",
+		})
+	}
+	update, err := c.addPersisted(counterName(body), int(delta))
+	if err != nil {
+		log.Printf("Error storing add: %v", err)
+		c.Requests.Forget(requestId)
+		return err
+	}
+	c.Deltas.Push(update)
+	c.Requests.Done(requestId)
+	return c.Node.Reply(msg, map[string]any{
+		"type": "add_ok",
+	})
+}
+
+// Periodically sends every peer the deltas it hasn't acknowledged, or full state if they were dropped
+func (c *Counter) GossipDeltas() error {
+	for {
+		time.Sleep(c.Config.GossipInterval)
+		peers := c.peers()
+		for _, node := range peers {
+			delta, end, ok := c.Deltas.For(node)
+			kind := "delta"
+			if !ok {
+				kind = "full"
+				delta = c.State.copy()
+			}
+			if delta.Empty() {
+				continue
+			}
+			body := map[string]any{
+				"type":     "delta",
+				"counters": delta.Counters,
+				"history":  delta.History,
+				"end":      end,
+			}
+			c.Metrics.Record(kind, body)
+			_ = c.Node.RPC(node, body, func(reply maelstrom.Message) error {
+				// A peer that failed to merge must get the delta again
+				if reply.RPCError() != nil {
+					return nil
+				}
+				c.Deltas.Ack(node, end, peers)
+				return nil
+			})
+		}
+	}
+}
+
+// Merges a delta or full state. Whatever grows our state is passed on, so it also reaches nodes
+// the sender can't reach directly.
+func (c *Counter) MergeDelta(msg maelstrom.Message) error {
+	var body Update
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if grown := c.State.Merge(body); !grown.Empty() {
+		c.Deltas.Push(grown)
+	}
+	return c.Node.Reply(msg, map[string]any{
+		"type": "delta_ok",
+	})
+}
+
+func (c *Counter) peers() []string {
+	peers := make([]string, 0, len(c.Node.NodeIDs()))
+	for _, node := range c.Node.NodeIDs() {
+		if node != c.Node.ID() {
+			peers = append(peers, node)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"github.com/notzree/gossip-glomers/crdt"
+)
+
+// History records how a counter grew over time. Every bucket, keyed by its start in unix
+// milliseconds, holds a PN-Counter of each node's running totals as of its last add during the
+// bucket. Totals only grow, so buckets merge like any PN-Counter, and the count at time T is the
+// value of the join of every bucket starting at or before T.
+//
+// Downsampling and retention only move buckets to a coarser key, merging them into whatever is
+// there already. Merging running totals keeps the latest of them, so a replica can do this on its
+// own at any time and still converge with one that hasn't yet.
+type History map[int64]*crdt.PNCounter
+
+// Histories holds a History by counter name, either whole or as join-deltas
+type Histories map[string]History
+
+func (h Histories) Empty() bool {
+	for _, history := range h {
+		for _, bucket := range history {
+			if !bucket.Empty() {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (h Histories) Join(other Histories) {
+	for name, history := range other {
+		for start, bucket := range history {
+			if bucket != nil {
+				h.bucket(name, start).Merge(bucket)
+			}
+		}
+	}
+}
+
+func (h Histories) bucket(name string, start int64) *crdt.PNCounter {
+	if h[name] == nil {
+		h[name] = make(History)
+	}
+	if h[name][start] == nil {
+		h[name][start] = crdt.NewPNCounter()
+	}
+	return h[name][start]
+}
+
+// Returns the start of the bucket a time falls in. Times within HistoryDownsampleAfter of now get
+// HistoryBucket wide buckets and older ones HistoryCoarseBucket wide ones, while everything past
+// HistoryRetention is folded into a single bucket at 0, which keeps the totals reached before then.
+func (c Config) bucket(at int64, now int64) int64 {
+	switch age := time.Duration(now-at) * time.Millisecond; {
+	case age >= c.HistoryRetention:
+		return 0
+	case age >= c.HistoryDownsampleAfter:
+		return at - at%c.HistoryCoarseBucket.Milliseconds()
+	default:
+		return at - at%c.HistoryBucket.Milliseconds()
+	}
+}
+
+// Answers read_window with how much was added to a counter over the last seconds. Like read
+// with at, it is rounded to the bucket the start of the window falls in.
+func (c *Counter) ReadWindow(msg maelstrom.Message) error {
+	if c.Config.Mode != StateMode && c.Config.Mode != DeltaMode {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "history needs the state or delta mode")
+	}
+	var body struct {
+		Counter string  `json:"counter"`
+		Seconds float64 `json:"seconds"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Seconds <= 0 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "seconds must be positive")
+	}
+	now := time.Now().UnixMilli()
+	start := now - int64(body.Seconds*1000)
+	before, ok := c.State.ValueAt(body.Counter, start, now)
+	if !ok {
+		return c.beyondRetention()
+	}
+	after, _ := c.State.ValueAt(body.Counter, now, now)
+	return c.Node.Reply(msg, map[string]any{
+		"type":  "read_window_ok",
+		"value": after - before,
+	})
+}
+
+func (c *Counter) beyondRetention() error {
+	return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+		"history only reaches back "+c.Config.HistoryRetention.String())
+}
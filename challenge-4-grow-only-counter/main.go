@@ -8,11 +8,35 @@ import (
 
 func main() {
 	n := maelstrom.NewNode()
-	counter := NewCounter(n)
-	n.Handle("init", counter.Init)
-	n.Handle("add", counter.Add)
-	n.Handle("read", counter.Read)
-	n.Handle("sync", counter.Sync)
+	config := LoadConfig()
+	counter := NewCounter(n, config)
+	go counter.LogMetrics()
+	n.Handle("metrics", counter.ReportMetrics)
+	n.Handle("list_counters", counter.ListCounters)
+	n.Handle("read_window", counter.ReadWindow)
+	switch config.Mode {
+	case StateMode:
+		go counter.GossipState()
+		n.Handle("init", counter.StateInit)
+		n.Handle("add", counter.StateAdd)
+		n.Handle("read", counter.StateRead)
+		n.Handle("merge", counter.MergeState)
+	case CasMode:
+		n.Handle("init", counter.CasInit)
+		n.Handle("add", counter.CasAdd)
+		n.Handle("read", counter.CasRead)
+	case DeltaMode:
+		go counter.GossipDeltas()
+		n.Handle("init", counter.StateInit)
+		n.Handle("add", counter.DeltaAdd)
+		n.Handle("read", counter.StateRead)
+		n.Handle("delta", counter.MergeDelta)
+	default:
+		n.Handle("init", counter.Init)
+		n.Handle("add", counter.Add)
+		n.Handle("read", counter.Read)
+		n.Handle("sync", counter.Sync)
+	}
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
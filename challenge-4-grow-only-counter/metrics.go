@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Metrics counts the replication messages and KV requests this node sent and their encoded size,
+// per kind. KV requests are counted without the fields the library adds, such as msg_id.
+type Metrics struct {
+	Mutex    *sync.Mutex
+	Messages map[string]int
+	Bytes    map[string]int
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Mutex:    &sync.Mutex{},
+		Messages: make(map[string]int),
+		Bytes:    make(map[string]int),
+	}
+}
+
+func (m *Metrics) Record(kind string, body map[string]any) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	m.Messages[kind]++
+	m.Bytes[kind] += len(encoded)
+}
+
+func (m *Metrics) copy() (map[string]int, map[string]int) {
+	m.Mutex.Lock()
+	defer m.Mutex.Unlock()
+	messages := make(map[string]int, len(m.Messages))
+	bytes := make(map[string]int, len(m.Bytes))
+	for kind, count := range m.Messages {
+		messages[kind] = count
+		bytes[kind] = m.Bytes[kind]
+	}
+	return messages, bytes
+}
+
+func (c *Counter) ReportMetrics(msg maelstrom.Message) error {
+	messages, bytes := c.Metrics.copy()
+	return c.Node.Reply(msg, map[string]any{
+		"type":     "metrics_ok",
+		"messages": messages,
+		"bytes":    bytes,
+	})
+}
+
+// Periodically logs the metrics, so they end up in Maelstrom's node logs
+func (c *Counter) LogMetrics() error {
+	for {
+		time.Sleep(5 * time.Second)
+		messages, bytes := c.Metrics.copy()
+		for kind, count := range messages {
+			log.Printf("metrics: %d %s messages, %d bytes, %d bytes per message", count, kind, bytes[kind], bytes[kind]/count)
+		}
+	}
+}
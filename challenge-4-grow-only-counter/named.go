@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// In sync-on-read mode every node keeps its count of a named counter under <counter>/<node>, and the
+// names it has added to under names-<node>, so that list_counters can find them after a restart.
+// The state and delta modes keep their own entries under the same keys.
+// The unnamed counter keeps the plain <node> key that Init creates. Neither of those has a slash,
+// so no counter name can collide with them.
+func (c *Counter) key(counter string) string {
+	if counter == defaultCounter {
+		return c.Id
+	}
+	return counter + "/" + c.Id
+}
+
+func namesKey(node string) string {
+	return "names-" + node
+}
+
+// Reads one of our own keys, which counts as 0 until the first add creates it
+func (c *Counter) readOwn(ctx context.Context, key string) (int, error) {
+	c.Metrics.Record("kv-read", map[string]any{"type": "read", "key": key})
+	value, err := c.Kv.ReadInt(ctx, key)
+	if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+		return 0, nil
+	}
+	return value, err
+}
+
+// Reads a node's registered names, which are none until it first adds to a named counter
+func (c *Counter) readNames(ctx context.Context, node string) ([]string, error) {
+	key := namesKey(node)
+	c.Metrics.Record("kv-read", map[string]any{"type": "read", "key": key})
+	value, err := c.Kv.Read(ctx, key)
+	if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stored, _ := value.([]any)
+	names := make([]string, 0, len(stored))
+	for _, name := range stored {
+		if name, ok := name.(string); ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Adds counter to our registered names before our first add to it. Names are kept sorted, so the
+// swap compares like with like. Must hold KvMutex.
+func (c *Counter) register(ctx context.Context, counter string) error {
+	if _, registered := c.Names[counter]; registered || counter == defaultCounter {
+		return nil
+	}
+	key := namesKey(c.Id)
+	for attempt := 0; ; attempt++ {
+		names, err := c.readNames(ctx, c.Id)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(names, counter) {
+			break
+		}
+		updated := append(slices.Clone(names), counter)
+		slices.Sort(updated)
+		c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": key, "from": names, "to": updated})
+		err = c.Kv.CompareAndSwap(ctx, key, names, updated, true)
+		if err == nil {
+			break
+		}
+		// A stale read after a restart, as nobody else writes our names
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return err
+		}
+		time.Sleep(c.backoff(attempt))
+	}
+	c.Names[counter] = struct{}{}
+	return nil
+}
+
+// Returns the union of every node's registered names, sorted. A node's names may be read stale, so
+// like the CRDT modes this lists the names seen so far.
+func (c *Counter) listNames(ctx context.Context) ([]string, error) {
+	seen := make(map[string]struct{})
+	for _, node := range c.Node.NodeIDs() {
+		names, err := c.readNames(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			seen[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Entries are a node's own halves of one PN-Counter. In state and delta modes every node stores
+// its entries of each counter in seq-kv under the same keys sync-on-read uses, so a node that
+// restarts gets back the adds it acknowledged but hadn't gossiped yet.
+type Entries struct {
+	Increments int `json:"increments"`
+	Decrements int `json:"decrements"`
+}
+
+func (e Entries) add(delta int) Entries {
+	if delta < 0 {
+		e.Decrements -= delta
+	} else {
+		e.Increments += delta
+	}
+	return e
+}
+
+// Restores this node's stored entries of every counter it registered before it answers init.
+// A nonce is written first, so that the reads see what this node wrote before it restarted.
+func (c *Counter) StateInit(msg maelstrom.Message) error {
+	c.Id = c.Node.ID()
+	c.KvMutex.Lock()
+	defer c.KvMutex.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key := "nonce-" + c.Id
+	nonce := time.Now().UnixNano()
+	c.Metrics.Record("kv-write", map[string]any{"type": "write", "key": key, "value": nonce})
+	if err := c.Kv.Write(ctx, key, nonce); err != nil {
+		log.Printf("Error writing %s: %v", key, err)
+		return err
+	}
+	names, err := c.readNames(ctx, c.Id)
+	if err != nil {
+		log.Printf("Error reading counter names: %v", err)
+		return err
+	}
+	for _, counter := range append([]string{defaultCounter}, names...) {
+		if err := c.restore(ctx, counter); err != nil {
+			log.Printf("Error restoring counter %q: %v", counter, err)
+			return err
+		}
+		if counter != defaultCounter {
+			c.Names[counter] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// Stores our entries of counter with delta added, then applies the add to the replica and returns
+// its join-delta. Holding KvMutex across both keeps what is stored in step with the replica, so
+// the swap only fails if the replica is behind our key, which restoring it fixes.
+func (c *Counter) addPersisted(counter string, delta int) (Update, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.KvMutex.Lock()
+	defer c.KvMutex.Unlock()
+	if err := c.register(ctx, counter); err != nil {
+		return Update{}, err
+	}
+	key := c.key(counter)
+	for attempt := 0; ; attempt++ {
+		current := c.State.Own(counter, c.Id)
+		next := current.add(delta)
+		c.Metrics.Record("kv-cas", map[string]any{"type": "cas", "key": key, "from": current, "to": next})
+		err := c.Kv.CompareAndSwap(ctx, key, current, next, true)
+		if err == nil {
+			break
+		}
+		if maelstrom.ErrorCode(err) != maelstrom.PreconditionFailed {
+			return Update{}, err
+		}
+		if err := c.restore(ctx, counter); err != nil {
+			return Update{}, err
+		}
+		time.Sleep(c.backoff(attempt))
+	}
+	return c.State.Add(counter, c.Id, delta), nil
+}
+
+// Merges our stored entries of counter into the replica. In delta mode whatever that grows is
+// queued for peers too, as they may never have heard of the adds it brings back. Must hold KvMutex.
+func (c *Counter) restore(ctx context.Context, counter string) error {
+	key := c.key(counter)
+	c.Metrics.Record("kv-read", map[string]any{"type": "read", "key": key})
+	value, err := c.Kv.Read(ctx, key)
+	if maelstrom.ErrorCode(err) == maelstrom.KeyDoesNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var entries Entries
+	if err := json.Unmarshal(encoded, &entries); err != nil {
+		return err
+	}
+	grown := c.State.Restore(counter, c.Id, entries)
+	if c.Config.Mode == DeltaMode && !grown.Empty() {
+		c.Deltas.Push(grown)
+	}
+	return nil
+}
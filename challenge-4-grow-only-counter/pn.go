@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/notzree/gossip-glomers/crdt"
+)
+
+// The counter Maelstrom's workloads use, which is what add and read touch when they name no counter
+const defaultCounter = ""
+
+// States holds PN-Counters by counter name, either whole or as join-deltas. A PN-Counter pairs a
+// G-Counter of increments with one of decrements, so with only increments it is a G-Counter.
+type States map[string]*crdt.PNCounter
+
+func (s States) Empty() bool {
+	for _, state := range s {
+		if !state.Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// Merges other into s, counter by counter
+func (s States) Join(other States) {
+	for name, state := range other {
+		if state == nil {
+			continue
+		}
+		if s[name] == nil {
+			s[name] = crdt.NewPNCounter()
+		}
+		s[name].Merge(state)
+	}
+}
+
+// Update is what the state and delta modes replicate: counters and their histories, either
+// whole or as join-deltas
+type Update struct {
+	Counters States    `json:"counters"`
+	History  Histories `json:"history,omitempty"`
+}
+
+func (u Update) Empty() bool {
+	return u.Counters.Empty() && u.History.Empty()
+}
+
+func (u Update) Join(other Update) {
+	u.Counters.Join(other.Counters)
+	u.History.Join(other.History)
+}
+
+func NewUpdate() Update {
+	return Update{Counters: make(States), History: make(Histories)}
+}
+
+// Replica guards the counters shared by the state and delta mode handlers. A counter only exists
+// once something was added to it here or merged in from another node, so memory and gossip grow
+// with the counters actually in use.
+type Replica struct {
+	Mutex    *sync.Mutex
+	Config   Config
+	Counters States
+	History  Histories
+}
+
+func NewReplica(config Config) *Replica {
+	return &Replica{
+		Mutex:    &sync.Mutex{},
+		Config:   config,
+		Counters: make(States),
+		History:  make(Histories),
+	}
+}
+
+// Adds delta to node's entries in a counter and records its new totals in the current bucket.
+// Returns the join-delta, which is just the entries that changed.
+func (r *Replica) Add(counter string, node string, delta int) Update {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	now := time.Now().UnixMilli()
+	r.compact(now)
+	if r.Counters[counter] == nil {
+		r.Counters[counter] = crdt.NewPNCounter()
+	}
+	state := r.Counters[counter]
+	state.Add(node, delta)
+	totals := crdt.NewPNCounter()
+	totals.Add(node, state.Increments.Counts()[node])
+	totals.Add(node, -state.Decrements.Counts()[node])
+	start := r.Config.bucket(now, now)
+	bucket := r.History.bucket(counter, start)
+	bucket.Merge(totals)
+	return Update{
+		Counters: States{counter: state.Delta()},
+		History:  Histories{counter: History{start: bucket.Delta()}},
+	}
+}
+
+// Returns the entries that grew, which is the join-delta worth passing on
+func (r *Replica) Merge(update Update) Update {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.Counters.Join(update.Counters)
+	r.History.Join(update.History)
+	grown := NewUpdate()
+	for name := range update.Counters {
+		if r.Counters[name] == nil {
+			continue
+		}
+		if delta := r.Counters[name].Delta(); !delta.Empty() {
+			grown.Counters[name] = delta
+		}
+	}
+	for name, history := range update.History {
+		for start := range history {
+			if bucket := r.History[name][start]; bucket != nil {
+				if delta := bucket.Delta(); !delta.Empty() {
+					grown.History.bucket(name, start).Merge(delta)
+				}
+			}
+		}
+	}
+	r.compact(time.Now().UnixMilli())
+	return grown
+}
+
+// Returns node's own entries of a counter
+func (r *Replica) Own(counter string, node string) Entries {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Counters[counter] == nil {
+		return Entries{}
+	}
+	return Entries{
+		Increments: r.Counters[counter].Increments.Counts()[node],
+		Decrements: r.Counters[counter].Decrements.Counts()[node],
+	}
+}
+
+// Merges node's stored entries of a counter back in and returns the join-delta. The history
+// isn't restored, so reads with at may miss adds the node hadn't gossiped before it restarted.
+func (r *Replica) Restore(counter string, node string, entries Entries) Update {
+	state := crdt.NewPNCounter()
+	state.Add(node, entries.Increments)
+	state.Add(node, -entries.Decrements)
+	update := NewUpdate()
+	update.Counters[counter] = state
+	return r.Merge(update)
+}
+
+func (r *Replica) Value(counter string) int {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Counters[counter] == nil {
+		return 0
+	}
+	return r.Counters[counter].Value()
+}
+
+// Returns a counter's value as of the end of the bucket at falls in, or false if that is
+// further back than the history reaches
+func (r *Replica) ValueAt(counter string, at int64, now int64) (int, bool) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if r.Config.bucket(at, now) == 0 {
+		return 0, false
+	}
+	totals := crdt.NewPNCounter()
+	for start, bucket := range r.History[counter] {
+		if start <= at {
+			totals.Merge(bucket)
+		}
+	}
+	return totals.Value(), true
+}
+
+// Returns the names of every counter in use, in order, leaving out the default one
+func (r *Replica) Names() []string {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	names := make([]string, 0, len(r.Counters))
+	for name := range r.Counters {
+		if name != defaultCounter {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (r *Replica) copy() Update {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	update := NewUpdate()
+	update.Counters.Join(r.Counters)
+	update.History.Join(r.History)
+	return update
+}
+
+// Moves every bucket that aged past a boundary into the coarser bucket it now falls in. Must hold Mutex.
+func (r *Replica) compact(now int64) {
+	for name, history := range r.History {
+		for start, bucket := range history {
+			if coarse := r.Config.bucket(start, now); coarse != start {
+				r.History.bucket(name, coarse).Merge(bucket)
+				delete(history, start)
+			}
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Adds to this node's entries. Nothing leaves the node until the next gossip round.
+func (c *Counter) StateAdd(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	delta, ok := body["delta"].(float64)
+	if !ok {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "delta must be a number")
+	}
+	requestId, _ := body["request_id"].(string)
+	if !c.Requests.Claim(requestId) {
+		return c.Node.Reply(msg, map[string]any{
+			"type": "add_ok",
+		})
+	}
+	if _, err := c.addPersisted(counterName(body), int(delta)); err != nil {
+		log.Printf("Error storing add: %v", err)
+		c.Requests.Forget(requestId)
+		return err
+	}
+	c.Requests.Done(requestId)
+	return c.Node.Reply(msg, map[string]any{
+		"type": "add_ok",
+	})
+}
+
+// Answered from local state, so it stays available during partitions. With at, a time in unix
+// milliseconds, it answers from the history with the value as of the end of the bucket at falls in.
+func (c *Counter) StateRead(msg maelstrom.Message) error {
+	var body struct {
+		Counter string `json:"counter"`
+		At      *int64 `json:"at"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.At == nil {
+		return c.Node.Reply(msg, map[string]any{
+			"type":  "read_ok",
+			"value": c.State.Value(body.Counter),
+		})
+	}
+	value, ok := c.State.ValueAt(body.Counter, *body.At, time.Now().UnixMilli())
+	if !ok {
+		return c.beyondRetention()
+	}
+	return c.Node.Reply(msg, map[string]any{
+		"type":  "read_ok",
+		"value": value,
+		"at":    *body.At,
+	})
+}
+
+func (c *Counter) ListCounters(msg maelstrom.Message) error {
+	if c.Config.Mode == SyncOnRead {
+		ctx, cancel := context.WithTimeout(context.Background(), c.Config.ReadTimeout)
+		defer cancel()
+		names, err := c.listNames(ctx)
+		if err != nil {
+			log.Printf("Error listing counters: %v", err)
+			return err
+		}
+		return c.Node.Reply(msg, map[string]any{
+			"type":     "list_counters_ok",
+			"counters": names,
+		})
+	}
+	return c.Node.Reply(msg, map[string]any{
+		"type":     "list_counters_ok",
+		"counters": c.State.Names(),
+	})
+}
+
+// Returns the counter an add or read names, or the default one if it names none
+func counterName(body map[string]any) string {
+	name, _ := body["counter"].(string)
+	return name
+}
+
+// Periodically sends our whole state to every other node. A lost message is made up for by the
+// next round, so states converge once a partition heals.
+func (c *Counter) GossipState() error {
+	for {
+		time.Sleep(c.Config.GossipInterval)
+		state := c.State.copy()
+		for _, node := range c.Node.NodeIDs() {
+			if node == c.Node.ID() {
+				continue
+			}
+			body := map[string]any{
+				"type":     "merge",
+				"counters": state.Counters,
+				"history":  state.History,
+			}
+			c.Metrics.Record("full", body)
+			_ = c.Node.Send(node, body)
+		}
+	}
+}
+
+func (c *Counter) MergeState(msg maelstrom.Message) error {
+	var body Update
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	c.State.Merge(body)
+	return nil
+}
@@ -1,9 +1,15 @@
 #!/bin/bash
+# Usage: ./test.sh [mode] [extra maelstrom args], e.g. ./test.sh state --node-count 5
+# Modes: sync-on-read (default), state, delta and cas
+# Set COUNTER_WORKLOAD=pn-counter to run the pn-counter workload instead (state and delta modes only)
 
 maelstrom_path="../maelstrom"  
 cwd=$(pwd)
+mode=${1:-sync-on-read}
+workload=${COUNTER_WORKLOAD:-g-counter}
+shift $(( $# > 0 ? 1 : 0 ))
 
 go build -o bin
 cd "$maelstrom_path" || exit
-./maelstrom test -w g-counter --bin $cwd/bin --node-count 3 --rate 100 --time-limit 20 --nemesis partition
+COUNTER_MODE=$mode ./maelstrom test -w $workload --bin $cwd/bin --node-count 3 --rate 100 --time-limit 20 --nemesis partition "$@"
 cd "$cwd" || exit
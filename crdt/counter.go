@@ -0,0 +1,147 @@
+package crdt
+
+import "encoding/json"
+
+// GCounter is a grow-only counter. Every node only ever increments its own entry, so states
+// merge by taking the element-wise max.
+type GCounter struct {
+	counts map[string]int
+	delta  map[string]int
+}
+
+func NewGCounter() *GCounter {
+	return &GCounter{
+		counts: make(map[string]int),
+		delta:  make(map[string]int),
+	}
+}
+
+// Adds n, which must not be negative, to node's entry
+func (g *GCounter) Increment(node string, n int) {
+	if n > 0 {
+		g.record(node, g.counts[node]+n)
+	}
+}
+
+func (g *GCounter) Merge(other *GCounter) {
+	for node, count := range other.counts {
+		if count > g.counts[node] {
+			g.record(node, count)
+		}
+	}
+}
+
+func (g *GCounter) Value() int {
+	value := 0
+	for _, count := range g.counts {
+		value += count
+	}
+	return value
+}
+
+func (g *GCounter) Delta() *GCounter {
+	delta := &GCounter{counts: g.delta, delta: make(map[string]int)}
+	g.delta = make(map[string]int)
+	return delta
+}
+
+// Returns a copy of every node's entry
+func (g *GCounter) Counts() map[string]int {
+	counts := make(map[string]int, len(g.counts))
+	for node, count := range g.counts {
+		counts[node] = count
+	}
+	return counts
+}
+
+func (g *GCounter) Empty() bool {
+	return len(g.counts) == 0
+}
+
+func (g *GCounter) record(node string, count int) {
+	g.counts[node] = count
+	g.delta[node] = count
+}
+
+// Encoded as a plain object of node to count
+func (g *GCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(g.counts)
+}
+
+func (g *GCounter) UnmarshalJSON(data []byte) error {
+	counts := make(map[string]int)
+	if err := json.Unmarshal(data, &counts); err != nil {
+		return err
+	}
+	g.counts = counts
+	g.delta = make(map[string]int)
+	return nil
+}
+
+// PNCounter pairs a G-Counter of increments with one of decrements. Both halves only grow,
+// but the value is their difference, so it can go down.
+type PNCounter struct {
+	Increments *GCounter
+	Decrements *GCounter
+}
+
+func NewPNCounter() *PNCounter {
+	return &PNCounter{
+		Increments: NewGCounter(),
+		Decrements: NewGCounter(),
+	}
+}
+
+// Adds delta to node's entry on the side matching its sign
+func (p *PNCounter) Add(node string, delta int) {
+	if delta < 0 {
+		p.Decrements.Increment(node, -delta)
+	} else {
+		p.Increments.Increment(node, delta)
+	}
+}
+
+func (p *PNCounter) Merge(other *PNCounter) {
+	p.Increments.Merge(other.Increments)
+	p.Decrements.Merge(other.Decrements)
+}
+
+func (p *PNCounter) Value() int {
+	return p.Increments.Value() - p.Decrements.Value()
+}
+
+func (p *PNCounter) Delta() *PNCounter {
+	return &PNCounter{
+		Increments: p.Increments.Delta(),
+		Decrements: p.Decrements.Delta(),
+	}
+}
+
+func (p *PNCounter) Empty() bool {
+	return p.Increments.Empty() && p.Decrements.Empty()
+}
+
+type pnCounterJSON struct {
+	Increments map[string]int `json:"increments,omitempty"`
+	Decrements map[string]int `json:"decrements,omitempty"`
+}
+
+// Empty halves are left out, so a PN-Counter that only grows encodes almost like a G-Counter
+func (p *PNCounter) MarshalJSON() ([]byte, error) {
+	return json.Marshal(pnCounterJSON{Increments: p.Increments.counts, Decrements: p.Decrements.counts})
+}
+
+func (p *PNCounter) UnmarshalJSON(data []byte) error {
+	var decoded pnCounterJSON
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*p = *NewPNCounter()
+	for node, count := range decoded.Increments {
+		p.Increments.counts[node] = count
+	}
+	for node, count := range decoded.Decrements {
+		p.Decrements.counts[node] = count
+	}
+	return nil
+}
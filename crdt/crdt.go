@@ -0,0 +1,36 @@
+// Package crdt holds the state based CRDTs shared by the challenges.
+//
+// Every type merges by a join that is commutative, associative and idempotent, so replicas can
+// exchange states in any order, any number of times, and still converge. Every type also tracks
+// a join-delta: whatever grew its state since the last call to Delta, whether through one of its
+// own mutators or through a merge. Shipping deltas instead of whole states is enough for replicas
+// to converge, and passing on the deltas produced by merges relays changes to replicas the
+// original sender can't reach.
+//
+// Types are not safe for concurrent use. Their JSON encodings are canonical, so two states are
+// equal exactly when they encode to the same bytes.
+package crdt
+
+import "encoding/json"
+
+// CRDT is implemented by every type in this package, with S the type itself and V its value
+type CRDT[S any, V any] interface {
+	Merge(other S)
+	Value() V
+	// Returns the join-delta accumulated since the last call and starts accumulating a new one
+	Delta() S
+	json.Marshaler
+	json.Unmarshaler
+}
+
+var (
+	_ CRDT[*GCounter, int]                       = (*GCounter)(nil)
+	_ CRDT[*PNCounter, int]                      = (*PNCounter)(nil)
+	_ CRDT[*GSet[int], []int]                    = (*GSet[int])(nil)
+	_ CRDT[*JSONSet, []any]                      = (*JSONSet)(nil)
+	_ CRDT[*TwoPSet[int], []int]                 = (*TwoPSet[int])(nil)
+	_ CRDT[*ORSet[int], []int]                   = (*ORSet[int])(nil)
+	_ CRDT[*LWWRegister[any], any]               = (*LWWRegister[any])(nil)
+	_ CRDT[*MVRegister[any], []any]              = (*MVRegister[any])(nil)
+	_ CRDT[*LWWMap[string, any], map[string]any] = (*LWWMap[string, any])(nil)
+)
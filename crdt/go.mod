@@ -0,0 +1,3 @@
+module github.com/notzree/gossip-glomers/crdt
+
+go 1.22.6
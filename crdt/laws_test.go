@@ -0,0 +1,185 @@
+package crdt
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+const (
+	replicas = 3
+	steps    = 30
+)
+
+var (
+	histories = flag.Int("histories", 1000, "random histories to check per type")
+	seed      = flag.Uint64("seed", 1, "random seed")
+)
+
+// Checks the merge laws of every type on randomly generated replicas
+func TestMergeLaws(t *testing.T) {
+	r := rand.New(rand.NewPCG(*seed, *seed))
+	check := func(name string, history func() error) {
+		t.Run(name, func(t *testing.T) {
+			for range *histories {
+				if err := history(); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+	check("g-counter", func() error {
+		return run(r, NewGCounter, func(s *GCounter, node string) {
+			s.Increment(node, r.IntN(5))
+		})
+	})
+	check("pn-counter", func() error {
+		return run(r, NewPNCounter, func(s *PNCounter, node string) {
+			s.Add(node, r.IntN(9)-4)
+		})
+	})
+	check("g-set", func() error {
+		return run(r, NewGSet[int], func(s *GSet[int], node string) {
+			s.Add(r.IntN(10))
+		})
+	})
+	// Values of different shapes, some equal once encoded
+	check("json-set", func() error {
+		return run(r, NewJSONSet, func(s *JSONSet, node string) {
+			elements := []any{r.IntN(5), float64(r.IntN(5)), fmt.Sprintf("e%d", r.IntN(3)), nil,
+				map[string]any{"b": r.IntN(2), "a": []any{1, "x"}}}
+			if err := s.Add(elements[r.IntN(len(elements))]); err != nil {
+				panic(err)
+			}
+		})
+	})
+	check("2p-set", func() error {
+		return run(r, NewTwoPSet[int], func(s *TwoPSet[int], node string) {
+			if r.IntN(3) == 0 {
+				s.Remove(r.IntN(10))
+			} else {
+				s.Add(r.IntN(10))
+			}
+		})
+	})
+	check("or-set", func() error {
+		return run(r, NewORSet[int], func(s *ORSet[int], node string) {
+			if r.IntN(3) == 0 {
+				s.Remove(r.IntN(5))
+			} else {
+				s.Add(node, r.IntN(5))
+			}
+		})
+	})
+	// Few distinct timestamps, so that ties between nodes come up
+	check("lww-register", func() error {
+		return run(r, NewLWWRegister[int], func(s *LWWRegister[int], node string) {
+			s.Set(node, r.IntN(10), r.Int64N(5))
+		})
+	})
+	check("mv-register", func() error {
+		return run(r, NewMVRegister[int], func(s *MVRegister[int], node string) {
+			s.Set(node, r.IntN(10))
+		})
+	})
+	check("lww-map", func() error {
+		return run(r, NewLWWMap[string, int], func(s *LWWMap[string, int], node string) {
+			key := fmt.Sprintf("k%d", r.IntN(4))
+			if r.IntN(3) == 0 {
+				s.Delete(node, key, r.Int64N(5))
+			} else {
+				s.Set(node, key, r.IntN(10), r.Int64N(5))
+			}
+		})
+	})
+}
+
+// Builds replicas from a random interleaving of mutations and merges, then checks the laws on them.
+// Every mutation is also checked to produce a delta that takes the state from before it to after it.
+func run[S CRDT[S, V], V any](r *rand.Rand, fresh func() S, mutate func(S, string)) error {
+	states := make([]S, replicas)
+	for i := range states {
+		states[i] = fresh()
+	}
+	for range steps {
+		i := r.IntN(replicas)
+		if j := r.IntN(replicas); r.IntN(4) == 0 && j != i {
+			states[i].Merge(states[j])
+			continue
+		}
+		states[i].Delta()
+		before := fresh()
+		before.Merge(states[i])
+		before.Delta()
+		mutate(states[i], fmt.Sprintf("n%d", i))
+		if err := checkDelta(before, states[i].Delta(), states[i], fresh); err != nil {
+			return err
+		}
+	}
+	return checkLaws(states[0], states[1], states[2], fresh)
+}
+
+// checkLaws returns an error if merging a, b and c isn't commutative, associative and idempotent,
+// or if any of them doesn't survive a round trip through JSON. States are compared by their
+// encodings, and fresh returns an empty state to decode copies into. The arguments aren't modified.
+func checkLaws[S CRDT[S, V], V any](a S, b S, c S, fresh func() S) error {
+	for _, state := range []S{a, b, c} {
+		if err := sameState(state, clone(state, fresh), "round trip"); err != nil {
+			return err
+		}
+	}
+	if err := sameState(merged(fresh, a, b), merged(fresh, b, a), "commutativity"); err != nil {
+		return err
+	}
+	left := merged(fresh, merged(fresh, a, b), c)
+	right := merged(fresh, a, merged(fresh, b, c))
+	if err := sameState(left, right, "associativity"); err != nil {
+		return err
+	}
+	return sameState(merged(fresh, a, a), a, "idempotence")
+}
+
+// checkDelta returns an error if merging delta into before doesn't give after, where delta is what
+// after's Delta returned following a mutation of a copy of before
+func checkDelta[S CRDT[S, V], V any](before S, delta S, after S, fresh func() S) error {
+	return sameState(merged(fresh, before, delta), after, "delta")
+}
+
+// Returns a copy of first with every state in rest merged into it
+func merged[S CRDT[S, V], V any](fresh func() S, first S, rest ...S) S {
+	result := clone(first, fresh)
+	for _, state := range rest {
+		result.Merge(clone(state, fresh))
+	}
+	return result
+}
+
+func clone[S CRDT[S, V], V any](state S, fresh func() S) S {
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		panic(err)
+	}
+	copied := fresh()
+	if err := json.Unmarshal(encoded, copied); err != nil {
+		panic(err)
+	}
+	return copied
+}
+
+func sameState[S CRDT[S, V], V any](a S, b S, law string) error {
+	encodedA, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	encodedB, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(encodedA, encodedB) {
+		return fmt.Errorf("%s violated: %s != %s", law, encodedA, encodedB)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package crdt
+
+import (
+	"cmp"
+	"encoding/json"
+)
+
+// LWWMap is a map whose every key is a last writer wins register. Deleting a key writes a
+// tombstone, so a delete and a concurrent write to the same key are ordered like two writes.
+type LWWMap[K cmp.Ordered, V any] struct {
+	registers map[K]*LWWRegister[lwwMapValue[V]]
+}
+
+type lwwMapValue[V any] struct {
+	Value   V    `json:"value,omitempty"`
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+func NewLWWMap[K cmp.Ordered, V any]() *LWWMap[K, V] {
+	return &LWWMap[K, V]{
+		registers: make(map[K]*LWWRegister[lwwMapValue[V]]),
+	}
+}
+
+func (m *LWWMap[K, V]) Set(node string, key K, value V, timestamp int64) {
+	m.register(key).Set(node, lwwMapValue[V]{Value: value}, timestamp)
+}
+
+func (m *LWWMap[K, V]) Delete(node string, key K, timestamp int64) {
+	m.register(key).Set(node, lwwMapValue[V]{Deleted: true}, timestamp)
+}
+
+func (m *LWWMap[K, V]) Get(key K) (V, bool) {
+	register, exists := m.registers[key]
+	if !exists || register.Value().Deleted {
+		var zero V
+		return zero, false
+	}
+	return register.Value().Value, true
+}
+
+func (m *LWWMap[K, V]) Merge(other *LWWMap[K, V]) {
+	for key, register := range other.registers {
+		if !register.Empty() {
+			m.register(key).Merge(register)
+		}
+	}
+}
+
+// Returns every key that isn't deleted
+func (m *LWWMap[K, V]) Value() map[K]V {
+	value := make(map[K]V, len(m.registers))
+	for key, register := range m.registers {
+		if !register.Value().Deleted {
+			value[key] = register.Value().Value
+		}
+	}
+	return value
+}
+
+func (m *LWWMap[K, V]) Delta() *LWWMap[K, V] {
+	delta := NewLWWMap[K, V]()
+	for key, register := range m.registers {
+		if changed := register.Delta(); !changed.Empty() {
+			delta.registers[key] = changed
+		}
+	}
+	return delta
+}
+
+func (m *LWWMap[K, V]) register(key K) *LWWRegister[lwwMapValue[V]] {
+	if m.registers[key] == nil {
+		m.registers[key] = NewLWWRegister[lwwMapValue[V]]()
+	}
+	return m.registers[key]
+}
+
+type lwwMapEntry[K cmp.Ordered, V any] struct {
+	Key      K                            `json:"key"`
+	Register *LWWRegister[lwwMapValue[V]] `json:"register"`
+}
+
+// Encoded as an array of key and register pairs, sorted by key, tombstones included
+func (m *LWWMap[K, V]) MarshalJSON() ([]byte, error) {
+	entries := make([]lwwMapEntry[K, V], 0, len(m.registers))
+	for _, key := range sorted(m.registers) {
+		entries = append(entries, lwwMapEntry[K, V]{Key: key, Register: m.registers[key]})
+	}
+	return json.Marshal(entries)
+}
+
+func (m *LWWMap[K, V]) UnmarshalJSON(data []byte) error {
+	var entries []lwwMapEntry[K, V]
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	*m = *NewLWWMap[K, V]()
+	for _, entry := range entries {
+		if entry.Register != nil {
+			m.registers[entry.Key] = entry.Register
+		}
+	}
+	return nil
+}
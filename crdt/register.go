@@ -0,0 +1,203 @@
+package crdt
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"slices"
+)
+
+// LWWRegister holds a single value, and the write with the highest timestamp wins. Writes with
+// the same timestamp are ordered by the node that made them, then by their encoded value, so
+// every replica picks the same winner.
+type LWWRegister[V any] struct {
+	value     V
+	timestamp int64
+	node      string
+	changed   bool // Whether anything was written or merged in since the last call to Delta
+}
+
+func NewLWWRegister[V any]() *LWWRegister[V] {
+	return &LWWRegister[V]{}
+}
+
+func (r *LWWRegister[V]) Set(node string, value V, timestamp int64) {
+	r.Merge(&LWWRegister[V]{value: value, timestamp: timestamp, node: node})
+}
+
+func (r *LWWRegister[V]) Merge(other *LWWRegister[V]) {
+	if other.compare(r) > 0 {
+		r.value = other.value
+		r.timestamp = other.timestamp
+		r.node = other.node
+		r.changed = true
+	}
+}
+
+func (r *LWWRegister[V]) Value() V {
+	return r.value
+}
+
+func (r *LWWRegister[V]) Timestamp() int64 {
+	return r.timestamp
+}
+
+// An unchanged register's delta is empty, and merging it changes nothing
+func (r *LWWRegister[V]) Delta() *LWWRegister[V] {
+	if !r.changed {
+		return NewLWWRegister[V]()
+	}
+	r.changed = false
+	return &LWWRegister[V]{value: r.value, timestamp: r.timestamp, node: r.node}
+}
+
+// Returns whether nothing was ever written
+func (r *LWWRegister[V]) Empty() bool {
+	return r.timestamp == 0 && r.node == ""
+}
+
+func (r *LWWRegister[V]) compare(other *LWWRegister[V]) int {
+	if c := cmp.Compare(r.timestamp, other.timestamp); c != 0 {
+		return c
+	}
+	if c := cmp.Compare(r.node, other.node); c != 0 {
+		return c
+	}
+	encoded, _ := json.Marshal(r.value)
+	otherEncoded, _ := json.Marshal(other.value)
+	return bytes.Compare(encoded, otherEncoded)
+}
+
+type lwwRegisterJSON[V any] struct {
+	Value     V      `json:"value"`
+	Timestamp int64  `json:"timestamp"`
+	Node      string `json:"node"`
+}
+
+func (r *LWWRegister[V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(lwwRegisterJSON[V]{Value: r.value, Timestamp: r.timestamp, Node: r.node})
+}
+
+func (r *LWWRegister[V]) UnmarshalJSON(data []byte) error {
+	var decoded lwwRegisterJSON[V]
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*r = LWWRegister[V]{value: decoded.Value, timestamp: decoded.Timestamp, node: decoded.Node}
+	return nil
+}
+
+// MVRegister is a multi-value register: concurrent writes are all kept, until a later write that
+// has seen them replaces them. Every value carries the vector clock of the write that made it.
+type MVRegister[V any] struct {
+	entries []mvEntry[V]
+	changed bool
+}
+
+type mvEntry[V any] struct {
+	Value V              `json:"value"`
+	Clock map[string]int `json:"clock"`
+}
+
+func NewMVRegister[V any]() *MVRegister[V] {
+	return &MVRegister[V]{entries: make([]mvEntry[V], 0)}
+}
+
+// Replaces every value seen so far with value
+func (r *MVRegister[V]) Set(node string, value V) {
+	clock := make(map[string]int)
+	for _, entry := range r.entries {
+		for n, count := range entry.Clock {
+			clock[n] = max(clock[n], count)
+		}
+	}
+	clock[node]++
+	r.entries = []mvEntry[V]{{Value: value, Clock: clock}}
+	r.changed = true
+}
+
+// Keeps every value whose clock isn't dominated by another value's clock
+func (r *MVRegister[V]) Merge(other *MVRegister[V]) {
+	candidates := append(slices.Clone(r.entries), other.entries...)
+	merged := make([]mvEntry[V], 0, len(candidates))
+	for i, entry := range candidates {
+		keep := true
+		for j, rival := range candidates {
+			if dominates(rival.Clock, entry.Clock) || j < i && equalClocks(rival.Clock, entry.Clock) {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			merged = append(merged, entry)
+		}
+	}
+	slices.SortFunc(merged, func(a, b mvEntry[V]) int {
+		encoded, _ := json.Marshal(a.Clock)
+		otherEncoded, _ := json.Marshal(b.Clock)
+		return bytes.Compare(encoded, otherEncoded)
+	})
+	if len(merged) != len(r.entries) || slices.ContainsFunc(merged, func(entry mvEntry[V]) bool {
+		return !slices.ContainsFunc(r.entries, func(own mvEntry[V]) bool { return equalClocks(own.Clock, entry.Clock) })
+	}) {
+		r.changed = true
+	}
+	r.entries = merged
+}
+
+// Returns every concurrent value
+func (r *MVRegister[V]) Value() []V {
+	values := make([]V, len(r.entries))
+	for i, entry := range r.entries {
+		values[i] = entry.Value
+	}
+	return values
+}
+
+// The delta of a changed register is the whole register, which only holds the latest writes anyway
+func (r *MVRegister[V]) Delta() *MVRegister[V] {
+	if !r.changed {
+		return NewMVRegister[V]()
+	}
+	r.changed = false
+	return &MVRegister[V]{entries: slices.Clone(r.entries)}
+}
+
+func (r *MVRegister[V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.entries)
+}
+
+func (r *MVRegister[V]) UnmarshalJSON(data []byte) error {
+	entries := make([]mvEntry[V], 0)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	*r = MVRegister[V]{}
+	r.Merge(&MVRegister[V]{entries: entries})
+	r.changed = false
+	return nil
+}
+
+// Reports whether a has seen everything b has and more
+func dominates(a map[string]int, b map[string]int) bool {
+	for node, count := range b {
+		if a[node] < count {
+			return false
+		}
+	}
+	return !equalClocks(a, b)
+}
+
+func equalClocks(a map[string]int, b map[string]int) bool {
+	for node, count := range a {
+		if b[node] != count {
+			return false
+		}
+	}
+	for node, count := range b {
+		if a[node] != count {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,393 @@
+package crdt
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// GSet is a grow-only set. States merge by union.
+type GSet[E cmp.Ordered] struct {
+	elements map[E]struct{}
+	delta    map[E]struct{}
+}
+
+func NewGSet[E cmp.Ordered]() *GSet[E] {
+	return &GSet[E]{
+		elements: make(map[E]struct{}),
+		delta:    make(map[E]struct{}),
+	}
+}
+
+func (s *GSet[E]) Add(element E) {
+	if _, exists := s.elements[element]; !exists {
+		s.elements[element] = struct{}{}
+		s.delta[element] = struct{}{}
+	}
+}
+
+func (s *GSet[E]) Contains(element E) bool {
+	_, exists := s.elements[element]
+	return exists
+}
+
+func (s *GSet[E]) Merge(other *GSet[E]) {
+	for element := range other.elements {
+		s.Add(element)
+	}
+}
+
+// Returns the elements in ascending order
+func (s *GSet[E]) Value() []E {
+	return sorted(s.elements)
+}
+
+func (s *GSet[E]) Delta() *GSet[E] {
+	delta := &GSet[E]{elements: s.delta, delta: make(map[E]struct{})}
+	s.delta = make(map[E]struct{})
+	return delta
+}
+
+func (s *GSet[E]) Len() int {
+	return len(s.elements)
+}
+
+// Encoded as an array of the elements in ascending order
+func (s *GSet[E]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Value())
+}
+
+func (s *GSet[E]) UnmarshalJSON(data []byte) error {
+	var elements []E
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+	*s = *NewGSet[E]()
+	for _, element := range elements {
+		s.elements[element] = struct{}{}
+	}
+	return nil
+}
+
+// JSONSet is a grow-only set of arbitrary JSON values, such as broadcast payloads, which GSet can't
+// hold as they aren't ordered. Elements are keyed by their encoding, so two values are the same
+// element exactly when they encode to the same bytes (encoding/json sorts object keys). Numbers
+// go through float64 on the way, as they do whenever a Maelstrom body is decoded into any.
+type JSONSet struct {
+	elements map[string]json.RawMessage
+	delta    map[string]json.RawMessage
+}
+
+func NewJSONSet() *JSONSet {
+	return &JSONSet{
+		elements: make(map[string]json.RawMessage),
+		delta:    make(map[string]json.RawMessage),
+	}
+}
+
+// Returns an error if element can't be encoded
+func (s *JSONSet) Add(element any) error {
+	encoded, err := canonical(element)
+	if err != nil {
+		return err
+	}
+	s.add(encoded)
+	return nil
+}
+
+func (s *JSONSet) Contains(element any) bool {
+	encoded, err := canonical(element)
+	if err != nil {
+		return false
+	}
+	_, exists := s.elements[string(encoded)]
+	return exists
+}
+
+func (s *JSONSet) Merge(other *JSONSet) {
+	for _, encoded := range other.elements {
+		s.add(encoded)
+	}
+}
+
+// Returns the elements decoded, ordered by their encoding
+func (s *JSONSet) Value() []any {
+	value := make([]any, 0, len(s.elements))
+	for _, key := range sorted(s.elements) {
+		var element any
+		if err := json.Unmarshal(s.elements[key], &element); err != nil {
+			panic(err) // Every stored encoding was produced by canonical
+		}
+		value = append(value, element)
+	}
+	return value
+}
+
+func (s *JSONSet) Delta() *JSONSet {
+	delta := &JSONSet{elements: s.delta, delta: make(map[string]json.RawMessage)}
+	s.delta = make(map[string]json.RawMessage)
+	return delta
+}
+
+func (s *JSONSet) Len() int {
+	return len(s.elements)
+}
+
+func (s *JSONSet) add(encoded json.RawMessage) {
+	if _, exists := s.elements[string(encoded)]; !exists {
+		s.elements[string(encoded)] = encoded
+		s.delta[string(encoded)] = encoded
+	}
+}
+
+// Encoded as an array of the elements ordered by their encoding
+func (s *JSONSet) MarshalJSON() ([]byte, error) {
+	encoded := make([]json.RawMessage, 0, len(s.elements))
+	for _, key := range sorted(s.elements) {
+		encoded = append(encoded, s.elements[key])
+	}
+	return json.Marshal(encoded)
+}
+
+func (s *JSONSet) UnmarshalJSON(data []byte) error {
+	var elements []json.RawMessage
+	if err := json.Unmarshal(data, &elements); err != nil {
+		return err
+	}
+	*s = *NewJSONSet()
+	for _, element := range elements {
+		// Re-encoded, as the input may not be canonical
+		encoded, err := canonical(element)
+		if err != nil {
+			return err
+		}
+		s.elements[string(encoded)] = encoded
+	}
+	return nil
+}
+
+// Encodes element the same way whatever Go type it was decoded into, by going through any
+func canonical(element any) (json.RawMessage, error) {
+	encoded, err := json.Marshal(element)
+	if err != nil {
+		return nil, err
+	}
+	var decoded any
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(decoded)
+}
+
+// TwoPSet is a set whose elements can be removed, but never added again afterwards. It is a
+// G-Set of added elements and a G-Set of removed ones.
+type TwoPSet[E cmp.Ordered] struct {
+	Added   *GSet[E] `json:"added"`
+	Removed *GSet[E] `json:"removed"`
+}
+
+func NewTwoPSet[E cmp.Ordered]() *TwoPSet[E] {
+	return &TwoPSet[E]{
+		Added:   NewGSet[E](),
+		Removed: NewGSet[E](),
+	}
+}
+
+func (s *TwoPSet[E]) Add(element E) {
+	s.Added.Add(element)
+}
+
+func (s *TwoPSet[E]) Remove(element E) {
+	s.Removed.Add(element)
+}
+
+func (s *TwoPSet[E]) Merge(other *TwoPSet[E]) {
+	s.Added.Merge(other.Added)
+	s.Removed.Merge(other.Removed)
+}
+
+// Returns the elements added and not removed, in ascending order
+func (s *TwoPSet[E]) Value() []E {
+	value := make([]E, 0, s.Added.Len())
+	for _, element := range s.Added.Value() {
+		if !s.Removed.Contains(element) {
+			value = append(value, element)
+		}
+	}
+	return value
+}
+
+func (s *TwoPSet[E]) Delta() *TwoPSet[E] {
+	return &TwoPSet[E]{
+		Added:   s.Added.Delta(),
+		Removed: s.Removed.Delta(),
+	}
+}
+
+func (s *TwoPSet[E]) MarshalJSON() ([]byte, error) {
+	type plain TwoPSet[E]
+	return json.Marshal((*plain)(s))
+}
+
+func (s *TwoPSet[E]) UnmarshalJSON(data []byte) error {
+	type plain TwoPSet[E]
+	decoded := plain(*NewTwoPSet[E]())
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*s = TwoPSet[E](decoded)
+	return nil
+}
+
+// ORSet is an observed-remove set: an element can be added again after being removed, and an add
+// concurrent with a remove wins. Every add tags the element with a unique tag, and a remove only
+// tombstones the tags it has seen.
+type ORSet[E cmp.Ordered] struct {
+	tags    map[E]map[string]struct{} // Live tags of each element
+	removed map[string]struct{}       // Tombstoned tags
+	clock   map[string]int            // Adds made by each node, used to generate unique tags
+	delta   *ORSet[E]
+}
+
+func NewORSet[E cmp.Ordered]() *ORSet[E] {
+	s := newORSet[E]()
+	s.delta = newORSet[E]()
+	return s
+}
+
+func newORSet[E cmp.Ordered]() *ORSet[E] {
+	return &ORSet[E]{
+		tags:    make(map[E]map[string]struct{}),
+		removed: make(map[string]struct{}),
+		clock:   make(map[string]int),
+	}
+}
+
+func (s *ORSet[E]) Add(node string, element E) {
+	s.clock[node]++
+	s.delta.clock[node] = s.clock[node]
+	tag := fmt.Sprintf("%s:%d", node, s.clock[node])
+	s.addTag(element, tag)
+	s.delta.addTag(element, tag)
+}
+
+// Removes every add of element seen so far
+func (s *ORSet[E]) Remove(element E) {
+	for tag := range s.tags[element] {
+		s.removed[tag] = struct{}{}
+		s.delta.removed[tag] = struct{}{}
+	}
+	delete(s.tags, element)
+}
+
+func (s *ORSet[E]) Contains(element E) bool {
+	return len(s.tags[element]) > 0
+}
+
+func (s *ORSet[E]) Merge(other *ORSet[E]) {
+	for node, count := range other.clock {
+		if count > s.clock[node] {
+			s.clock[node] = count
+			s.delta.clock[node] = count
+		}
+	}
+	for tag := range other.removed {
+		if _, exists := s.removed[tag]; !exists {
+			s.removed[tag] = struct{}{}
+			s.delta.removed[tag] = struct{}{}
+		}
+	}
+	for element, tags := range s.tags {
+		for tag := range tags {
+			if _, removed := s.removed[tag]; removed {
+				delete(tags, tag)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.tags, element)
+		}
+	}
+	for element, tags := range other.tags {
+		for tag := range tags {
+			_, removed := s.removed[tag]
+			_, exists := s.tags[element][tag]
+			if !removed && !exists {
+				s.addTag(element, tag)
+				s.delta.addTag(element, tag)
+			}
+		}
+	}
+}
+
+// Returns the elements in ascending order
+func (s *ORSet[E]) Value() []E {
+	return sorted(s.tags)
+}
+
+func (s *ORSet[E]) Delta() *ORSet[E] {
+	delta := s.delta
+	delta.delta = newORSet[E]()
+	s.delta = newORSet[E]()
+	return delta
+}
+
+func (s *ORSet[E]) addTag(element E, tag string) {
+	if s.tags[element] == nil {
+		s.tags[element] = make(map[string]struct{})
+	}
+	s.tags[element][tag] = struct{}{}
+}
+
+type orSetEntry[E cmp.Ordered] struct {
+	Element E        `json:"element"`
+	Tags    []string `json:"tags"`
+}
+
+type orSetJSON[E cmp.Ordered] struct {
+	Entries []orSetEntry[E] `json:"entries"`
+	Removed []string        `json:"removed"`
+	Clock   map[string]int  `json:"clock"`
+}
+
+// Entries are sorted by element, and tags are sorted too
+func (s *ORSet[E]) MarshalJSON() ([]byte, error) {
+	encoded := orSetJSON[E]{
+		Entries: make([]orSetEntry[E], 0, len(s.tags)),
+		Removed: sorted(s.removed),
+		Clock:   s.clock,
+	}
+	for _, element := range sorted(s.tags) {
+		encoded.Entries = append(encoded.Entries, orSetEntry[E]{Element: element, Tags: sorted(s.tags[element])})
+	}
+	return json.Marshal(encoded)
+}
+
+func (s *ORSet[E]) UnmarshalJSON(data []byte) error {
+	var decoded orSetJSON[E]
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+	*s = *NewORSet[E]()
+	for _, entry := range decoded.Entries {
+		for _, tag := range entry.Tags {
+			s.addTag(entry.Element, tag)
+		}
+	}
+	for _, tag := range decoded.Removed {
+		s.removed[tag] = struct{}{}
+	}
+	for node, count := range decoded.Clock {
+		s.clock[node] = count
+	}
+	return nil
+}
+
+func sorted[K cmp.Ordered, V any](m map[K]V) []K {
+	keys := make([]K, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,4 @@
+#!/bin/bash
+# Usage: ./test.sh [random histories per type] [seed]
+
+go test -count=1 . -args -histories "${1:-1000}" -seed "${2:-1}"
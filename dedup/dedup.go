@@ -0,0 +1,54 @@
+// Package dedup tracks which broadcast messages a node has seen, identified by the node they
+// originated from and that node's sequence number for them.
+package dedup
+
+// Set tracks which (origin, seq) pairs have been seen. Every sequence number at or below an
+// origin's watermark has been seen, so only the out of order ones above it are stored individually.
+type Set struct {
+	Watermarks map[string]int              `json:"watermarks"`
+	Pending    map[string]map[int]struct{} `json:"pending"`
+}
+
+func New() *Set {
+	return &Set{
+		Watermarks: make(map[string]int),
+		Pending:    make(map[string]map[int]struct{}),
+	}
+}
+
+// Records (origin, seq) and returns false if it had already been seen
+func (d *Set) Add(origin string, seq int) bool {
+	if d.Seen(origin, seq) {
+		return false
+	}
+	if seq != d.Watermarks[origin]+1 {
+		if d.Pending[origin] == nil {
+			d.Pending[origin] = make(map[int]struct{})
+		}
+		d.Pending[origin][seq] = struct{}{}
+		return true
+	}
+	// Advance the watermark over any pending sequence numbers that are now contiguous
+	d.Watermarks[origin] = seq
+	pending := d.Pending[origin]
+	for {
+		next := d.Watermarks[origin] + 1
+		if _, exists := pending[next]; !exists {
+			break
+		}
+		delete(pending, next)
+		d.Watermarks[origin] = next
+	}
+	if len(pending) == 0 {
+		delete(d.Pending, origin)
+	}
+	return true
+}
+
+func (d *Set) Seen(origin string, seq int) bool {
+	if seq <= d.Watermarks[origin] {
+		return true
+	}
+	_, exists := d.Pending[origin][seq]
+	return exists
+}
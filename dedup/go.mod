@@ -0,0 +1,3 @@
+module github.com/notzree/gossip-glomers/dedup
+
+go 1.22.6
@@ -0,0 +1,25 @@
+// Package env reads the settings of the challenge binaries. Maelstrom starts every binary without
+// arguments, so modes and limits come from environment variables, which each test.sh sets.
+package env
+
+import (
+	"os"
+	"strconv"
+)
+
+// Returns the variable's value, or fallback if it is unset or empty
+func String(key string, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok && value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Returns the variable as an int, or fallback if it is unset, empty or not a number
+func Int(key string, fallback int) int {
+	value, err := strconv.Atoi(String(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
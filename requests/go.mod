@@ -0,0 +1,3 @@
+module github.com/notzree/gossip-glomers/requests
+
+go 1.22.6
@@ -0,0 +1,101 @@
+// Package requests recognises the adds a client retries, by the request ID it sent with them, so
+// that the counter challenges apply each of them once.
+package requests
+
+import (
+	"sync"
+	"time"
+)
+
+// Set remembers the IDs of recently applied adds, so that an add a client retries isn't applied
+// twice. An ID is forgotten once it is older than Ttl, or when more than Limit are remembered,
+// oldest first. A retry that arrives while the original is still being applied waits for it.
+type Set struct {
+	Mutex   *sync.Mutex
+	Applied map[string]time.Time
+	Pending map[string]chan struct{} // Claimed IDs whose add hasn't finished yet, closed once it has
+	Order   []string                 // Remembered IDs, oldest first
+	Limit   int
+	Ttl     time.Duration
+}
+
+func New(limit int, ttl time.Duration) *Set {
+	return &Set{
+		Mutex:   &sync.Mutex{},
+		Applied: make(map[string]time.Time),
+		Pending: make(map[string]chan struct{}),
+		Limit:   limit,
+		Ttl:     ttl,
+	}
+}
+
+// Returns true if id wasn't applied yet, in which case the caller applies the add and then calls
+// Done or Forget. If another add with id is still being applied, this waits for its outcome first,
+// so a retry is only acknowledged once the original is, and takes over if the original failed.
+// An empty id is never remembered, so adds without one are always applied.
+func (r *Set) Claim(id string) bool {
+	if id == "" {
+		return true
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	for {
+		r.expire()
+		done, pending := r.Pending[id]
+		if !pending {
+			break
+		}
+		r.Mutex.Unlock()
+		<-done
+		r.Mutex.Lock()
+	}
+	if _, applied := r.Applied[id]; applied {
+		return false
+	}
+	r.Pending[id] = make(chan struct{})
+	return true
+}
+
+// Remembers id as applied, whether this node claimed it or the add arrived from a peer
+func (r *Set) Done(id string) {
+	if id == "" {
+		return
+	}
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	if _, applied := r.Applied[id]; !applied {
+		r.Order = append(r.Order, id)
+	}
+	r.Applied[id] = time.Now()
+	r.release(id)
+}
+
+// Releases id, for an add that was claimed but couldn't be applied
+func (r *Set) Forget(id string) {
+	r.Mutex.Lock()
+	defer r.Mutex.Unlock()
+	r.release(id)
+}
+
+// Must hold Mutex. Wakes the retries waiting on id.
+func (r *Set) release(id string) {
+	if done, pending := r.Pending[id]; pending {
+		close(done)
+		delete(r.Pending, id)
+	}
+}
+
+// Must hold Mutex
+func (r *Set) expire() {
+	for len(r.Order) > 0 {
+		oldest := r.Order[0]
+		applied, remembered := r.Applied[oldest]
+		if remembered && time.Since(applied) < r.Ttl && len(r.Applied) <= r.Limit {
+			return
+		}
+		if remembered {
+			delete(r.Applied, oldest)
+		}
+		r.Order = r.Order[1:]
+	}
+}